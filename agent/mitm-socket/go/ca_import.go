@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	gopkcs12 "software.sslmate.com/src/go-pkcs12"
+)
+
+// LoadAuthority loads a user supplied CA (eg, an org-wide MITM CA already trusted by browser images), or a CA with
+// its key on a PKCS#11 token. Returns nil if none is configured.
+func LoadAuthority(sessionArgs SessionArgs, storageDir string) (*x509.Certificate, crypto.Signer, error) {
+	if sessionArgs.CaPkcs11 != nil {
+		return loadPkcs11Authority(sessionArgs.CaPkcs11, sessionArgs.CaCertPath, storageDir, sessionArgs.CaNameConstraints)
+	}
+
+	if sessionArgs.CaPkcs12Path != "" {
+		pfx, err := os.ReadFile(sessionArgs.CaPkcs12Path)
+		if err != nil {
+			return nil, nil, err
+		}
+		privateKey, ca, _, err := gopkcs12.DecodeChain(pfx, sessionArgs.CaPkcs12Password)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Unable to read CA PKCS#12 (%s)", err)
+		}
+		key, ok := privateKey.(crypto.Signer)
+		if !ok {
+			return nil, nil, errors.New("CA PKCS#12 has an unsupported private key")
+		}
+		return ca, key, validateAuthority(ca, key)
+	}
+
+	if sessionArgs.CaCertPath == "" && sessionArgs.CaKeyPath == "" {
+		return nil, nil, nil
+	}
+	if sessionArgs.CaCertPath == "" || sessionArgs.CaKeyPath == "" {
+		return nil, nil, errors.New("A CA needs both CaCertPath and CaKeyPath")
+	}
+
+	certBytes, err := readPemOrDer(sessionArgs.CaCertPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	ca, err := x509.ParseCertificate(certBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyBytes, err := readPemOrDer(sessionArgs.CaKeyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := parsePrivateKey(keyBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ca, key, validateAuthority(ca, key)
+}
+
+// readPemOrDer returns the DER bytes of the first certificate or key PEM block in a file, or the file as-is if it
+// isn't PEM. Other blocks, like the EC PARAMETERS openssl ecparam writes before the key, are skipped.
+func readPemOrDer(file string) ([]byte, error) {
+	bytes, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, rest := pem.Decode(bytes)
+	if block == nil {
+		return bytes, nil
+	}
+	for ; block != nil; block, rest = pem.Decode(rest) {
+		if strings.HasSuffix(block.Type, " PARAMETERS") {
+			continue
+		}
+		if block.Type == "ENCRYPTED PRIVATE KEY" || block.Headers["Proc-Type"] != "" {
+			return nil, fmt.Errorf("Encrypted private keys are not supported (%s)", file)
+		}
+		return block.Bytes, nil
+	}
+	return nil, fmt.Errorf("No certificate or private key in %s", file)
+}
+
+// parsePrivateKey accepts PKCS#8, PKCS#1 (RSA) and SEC 1 (EC) encoded keys
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		if rsaKey, rsaErr := x509.ParsePKCS1PrivateKey(der); rsaErr == nil {
+			key, err = rsaKey, nil
+		} else if ecKey, ecErr := x509.ParseECPrivateKey(der); ecErr == nil {
+			key, err = ecKey, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported private key %T", key)
+	}
+	return signer, nil
+}
+
+func validateAuthority(ca *x509.Certificate, key crypto.Signer) error {
+	if !ca.IsCA {
+		return fmt.Errorf("Certificate %s is not a CA", ca.Subject)
+	}
+	publicKey, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !publicKey.Equal(ca.PublicKey) {
+		return fmt.Errorf("Private key doesn't match CA %s", ca.Subject)
+	}
+	return nil
+}
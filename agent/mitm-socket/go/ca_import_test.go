@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	gopkcs12 "software.sslmate.com/src/go-pkcs12"
+)
+
+func TestLoadAuthorityKeyAfterEcParameters(t *testing.T) {
+	config := newTestCertConfig(t, nil)
+	dir := t.TempDir()
+
+	keyDer, err := x509.MarshalECPrivateKey(config.caPrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// openssl ecparam -genkey writes the curve before the key
+	paramsPem := pem.EncodeToMemory(&pem.Block{Type: "EC PARAMETERS", Bytes: []byte{0x06, 0x08, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x03, 0x01, 0x07}})
+	keyPem := append(paramsPem, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})...)
+	sessionArgs := SessionArgs{CaCertPath: filepath.Join(dir, "ca.pem"), CaKeyPath: filepath.Join(dir, "ca.key")}
+	if err = os.WriteFile(sessionArgs.CaKeyPath, keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(sessionArgs.CaCertPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: config.ca.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ca, key, err := LoadAuthority(sessionArgs, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ca.Equal(config.ca) || !key.(*ecdsa.PrivateKey).Equal(config.caPrivateKey) {
+		t.Fatal("expected the imported CA and key")
+	}
+
+	if err = os.WriteFile(sessionArgs.CaKeyPath, paramsPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = LoadAuthority(sessionArgs, dir); err == nil {
+		t.Fatal("expected a file with only EC PARAMETERS to fail")
+	}
+}
+
+func TestLoadAuthorityModernPkcs12(t *testing.T) {
+	config := newTestCertConfig(t, nil)
+	pfx, err := gopkcs12.Modern.Encode(config.caPrivateKey, config.ca, nil, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	sessionArgs := SessionArgs{CaPkcs12Path: filepath.Join(dir, "ca.p12"), CaPkcs12Password: "secret"}
+	if err = os.WriteFile(sessionArgs.CaPkcs12Path, pfx, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ca, key, err := LoadAuthority(sessionArgs, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ca.Equal(config.ca) || !key.(*ecdsa.PrivateKey).Equal(config.caPrivateKey) {
+		t.Fatal("expected the CA and key of the AES encrypted PKCS#12")
+	}
+}
+
+func TestImportedAuthorityDoesNotReuseLeafKey(t *testing.T) {
+	generated := newTestCertConfig(t, nil)
+	dir := t.TempDir()
+	// the leaf key of a generated CA, left in the storage dir
+	stored, err := NewCertConfig(dir, nil, nil, KeyTypeEcdsaP256, KeyTypeEcdsaP256, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported, err := NewCertConfig(dir, generated.ca, generated.caPrivateKey, KeyTypeEcdsaP256, KeyTypeEcdsaP256, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.publicKey.(*ecdsa.PublicKey).Equal(stored.publicKey) {
+		t.Fatal("expected an imported CA to generate a new leaf key")
+	}
+
+	restarted, err := NewCertConfig(dir, nil, nil, KeyTypeEcdsaP256, KeyTypeEcdsaP256, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !restarted.publicKey.(*ecdsa.PublicKey).Equal(imported.publicKey) {
+		t.Fatal("expected the generated CA to reuse the stored leaf key")
+	}
+}
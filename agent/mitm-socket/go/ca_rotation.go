@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	defaultCaExpiryWarningDays = 60
+	defaultCaRotationDays      = 30
+	caExpiryCheckInterval      = 12 * time.Hour
+)
+
+// authority returns the current CA, its key and the PEM chain to append to leaf certificates
+func (c *CertConfig) authority() (*x509.Certificate, crypto.Signer, []byte) {
+	c.caMutex.RLock()
+	defer c.caMutex.RUnlock()
+
+	var chainPEM []byte
+	// clients that only trust the previous CA can build a path through the cross-signed certificate
+	if c.previousCa != nil && time.Now().Before(c.previousCa.NotAfter) {
+		chainPEM = c.caCrossCertPEM
+	}
+	return c.ca, c.caPrivateKey, chainPEM
+}
+
+// CheckAuthorityExpiry warns over ipc when the CA expires within warnDays. Generated CAs that expire within
+// rotationDays are replaced (rotationDays < 0 disables rotation).
+func (c *CertConfig) CheckAuthorityExpiry(warnDays int, rotationDays int) error {
+	if warnDays == 0 {
+		warnDays = defaultCaExpiryWarningDays
+	}
+	if rotationDays == 0 {
+		rotationDays = defaultCaRotationDays
+	}
+
+	ca, _, _ := c.authority()
+	if c.isGeneratedCa && rotationDays > 0 && time.Now().AddDate(0, 0, rotationDays).After(ca.NotAfter) {
+		return c.rotateAuthority()
+	}
+
+	if time.Now().AddDate(0, 0, warnDays).After(ca.NotAfter) {
+		SendToIpc(0, "caExpiring", map[string]interface{}{
+			"ca":         string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})),
+			"expireDate": ca.NotAfter.Unix(),
+			"isImported": !c.isGeneratedCa,
+		})
+	}
+	return nil
+}
+
+// WatchAuthorityExpiry re-runs CheckAuthorityExpiry periodically. Long running sessions can outlive the CA.
+func (c *CertConfig) WatchAuthorityExpiry(warnDays int, rotationDays int) {
+	ticker := time.NewTicker(caExpiryCheckInterval)
+	go func() {
+		for range ticker.C {
+			if err := c.CheckAuthorityExpiry(warnDays, rotationDays); err != nil {
+				SendErrorToIpc(0, "caRotation", err)
+			}
+		}
+	}()
+}
+
+// rotateAuthority replaces the CA in storageDir. The new CA is cross-signed by the previous one so certificates
+// stay valid for clients that haven't trusted the new root yet.
+func (c *CertConfig) rotateAuthority() error {
+	c.caMutex.Lock()
+	defer c.caMutex.Unlock()
+
+	previous, previousKey := c.ca, c.caPrivateKey
+
+	keyType := c.caKeyType
+	if keyType == "" {
+		var err error
+		keyType, err = keyTypeOf(previousKey.Public())
+		if err != nil {
+			return err
+		}
+	}
+
+	err := os.WriteFile(filepath.Join(c.storageDir, "caPrevious.der"), previous.Raw, 0600)
+	if err != nil {
+		return err
+	}
+
+	ca, caPrivateKey, err := createAuthority(c.storageDir, keyType, c.nameConstraints)
+	if err != nil {
+		return err
+	}
+
+	crossCert, err := crossSignAuthority(ca, previous, previousKey)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(filepath.Join(c.storageDir, "caCross.der"), crossCert, 0600)
+	if err != nil {
+		return err
+	}
+
+	c.ca = ca
+	c.caPrivateKey = caPrivateKey
+	c.previousCa = previous
+	c.caCrossCertPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: crossCert})
+
+	SendToIpc(0, "caRotated", map[string]interface{}{
+		"ca":                 string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})),
+		"expireDate":         ca.NotAfter.Unix(),
+		"previousCa":         string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: previous.Raw})),
+		"previousExpireDate": previous.NotAfter.Unix(),
+	})
+	return nil
+}
+
+// crossSignAuthority issues the ca's subject and key from the previous CA. It expires with the previous CA.
+func crossSignAuthority(ca *x509.Certificate, previous *x509.Certificate, previousKey crypto.Signer) ([]byte, error) {
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		RawSubject:            ca.RawSubject,
+		SubjectKeyId:          ca.SubjectKeyId,
+		KeyUsage:              ca.KeyUsage,
+		ExtKeyUsage:           ca.ExtKeyUsage,
+		BasicConstraintsValid: true,
+		NotBefore:             ca.NotBefore,
+		NotAfter:              previous.NotAfter,
+		IsCA:                  true,
+		// keep the constraints on the path through the previous CA
+		PermittedDNSDomainsCritical: ca.PermittedDNSDomainsCritical,
+		PermittedDNSDomains:         ca.PermittedDNSDomains,
+		ExcludedDNSDomains:          ca.ExcludedDNSDomains,
+		PermittedIPRanges:           ca.PermittedIPRanges,
+		ExcludedIPRanges:            ca.ExcludedIPRanges,
+	}
+	return x509.CreateCertificate(rand.Reader, tmpl, previous, ca.PublicKey, previousKey)
+}
+
+// loadCrossCert restores the cross-signed chain of a previous rotation while the previous CA is valid
+func (c *CertConfig) loadCrossCert() {
+	previous, err := readCertFromDisk(filepath.Join(c.storageDir, "caPrevious.der"))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Print("Error reading previous CA from disk ", err)
+		}
+		return
+	}
+	if time.Now().After(previous.NotAfter) {
+		return
+	}
+
+	crossCert, err := readCertFromDisk(filepath.Join(c.storageDir, "caCross.der"))
+	if err != nil {
+		log.Print("Error reading cross-signed CA from disk ", err)
+		return
+	}
+	// the CA was replaced since (eg, a different key type was requested)
+	if crossCert.CheckSignatureFrom(previous) != nil || !c.ca.PublicKey.(interface{ Equal(crypto.PublicKey) bool }).Equal(crossCert.PublicKey) {
+		return
+	}
+
+	c.previousCa = previous
+	c.caCrossCertPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: crossCert.Raw})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func parseChain(t *testing.T, chainPEM []byte) []*x509.Certificate {
+	t.Helper()
+	var chain []*x509.Certificate
+	for block, rest := pem.Decode(chainPEM); block != nil; block, rest = pem.Decode(rest) {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain = append(chain, cert)
+	}
+	return chain
+}
+
+func TestRotateAuthorityBeforeExpiry(t *testing.T) {
+	sent := captureIpc(t)
+	dir := t.TempDir()
+	config, err := NewCertConfig(dir, nil, nil, KeyTypeEcdsaP256, KeyTypeEcdsaP256, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := config.ca
+
+	// generated CAs are valid for a year
+	if err = config.CheckAuthorityExpiry(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !config.ca.Equal(previous) || len(sent()) != 0 {
+		t.Fatal("expected a CA that isn't about to expire to be kept")
+	}
+
+	if err = config.CheckAuthorityExpiry(0, 400); err != nil {
+		t.Fatal(err)
+	}
+	ca := config.ca
+	if ca.Equal(previous) || !config.previousCa.Equal(previous) {
+		t.Fatal("expected the CA to be rotated")
+	}
+	if messages := sent(); len(messages) != 1 || messages[0]["status"] != "caRotated" || messages[0]["previousExpireDate"] != float64(previous.NotAfter.Unix()) {
+		t.Fatalf("expected a caRotated message, got %v", messages)
+	}
+
+	// leaf chains include the new CA cross-signed by the previous one
+	certPEM, _, err := config.CreateCert("rotated.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := parseChain(t, certPEM)
+	if len(chain) != 2 {
+		t.Fatalf("expected the leaf and the cross-signed CA, got %d certificates", len(chain))
+	}
+	crossCert := chain[1]
+	if err = crossCert.CheckSignatureFrom(previous); err != nil {
+		t.Fatalf("expected the cross cert to be signed by the previous CA: %v", err)
+	}
+	if !crossCert.NotAfter.Equal(previous.NotAfter) || !bytes.Equal(crossCert.RawSubject, ca.RawSubject) {
+		t.Fatal("expected the cross cert to have the new CA's subject and expire with the previous CA")
+	}
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(crossCert)
+	for name, root := range map[string]*x509.Certificate{"previous": previous, "new": ca} {
+		roots := x509.NewCertPool()
+		roots.AddCert(root)
+		options := x509.VerifyOptions{Roots: roots, Intermediates: intermediates, DNSName: "rotated.example.com"}
+		if _, err = chain[0].Verify(options); err != nil {
+			t.Fatalf("expected the leaf to verify with the %s CA: %v", name, err)
+		}
+	}
+
+	// the rotation survives a restart
+	for _, file := range []string{"caPrevious.der", "caCross.der"} {
+		if _, err = os.Stat(filepath.Join(dir, file)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	restarted, err := NewCertConfig(dir, nil, nil, KeyTypeEcdsaP256, KeyTypeEcdsaP256, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !restarted.ca.Equal(ca) || !restarted.previousCa.Equal(previous) || !bytes.Equal(restarted.caCrossCertPEM, config.caCrossCertPEM) {
+		t.Fatal("expected the rotated CA and the cross cert to be reloaded")
+	}
+
+	// a CA created since isn't chained to the previous one
+	if err = os.Remove(filepath.Join(dir, "ca.der")); err != nil {
+		t.Fatal(err)
+	}
+	replaced, err := NewCertConfig(dir, nil, nil, KeyTypeEcdsaP256, KeyTypeEcdsaP256, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replaced.previousCa != nil || replaced.caCrossCertPEM != nil {
+		t.Fatal("expected a cross cert for another CA to be ignored")
+	}
+}
+
+func TestImportedAuthorityExpiryWarning(t *testing.T) {
+	sent := captureIpc(t)
+	generated := newTestCertConfig(t, nil)
+	config, err := NewCertConfig(t.TempDir(), generated.ca, generated.caPrivateKey, KeyTypeEcdsaP256, KeyTypeEcdsaP256, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = config.CheckAuthorityExpiry(400, 400); err != nil {
+		t.Fatal(err)
+	}
+	if !config.ca.Equal(generated.ca) {
+		t.Fatal("expected an imported CA to never be rotated")
+	}
+	messages := sent()
+	if len(messages) != 1 || messages[0]["status"] != "caExpiring" || messages[0]["isImported"] != true {
+		t.Fatalf("expected a caExpiring message, got %v", messages)
+	}
+}
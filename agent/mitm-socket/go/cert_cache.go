@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultCertCacheSize = 1000
+
+// cached certificates expiring sooner than this are generated again
+const certCacheMinRemaining = 24 * time.Hour
+
+// CertCache keeps generated leaf certificates by hostname and SAN set (least recently used are evicted first).
+// Concurrent requests for the same key share one signing operation.
+type CertCache struct {
+	sync.Mutex
+	entries  map[string]*cachedCert
+	keys     []string
+	capacity int
+	pending  map[string]*pendingCert
+}
+
+type cachedCert struct {
+	Cert []byte
+	// only set for certificates that don't use the init key (mirrored certificates)
+	PrivateKey string
+	ExpireDate int64
+	// the CA that signed the certificate. Entries from before a CA rotation are generated again.
+	ca *x509.Certificate
+}
+
+type pendingCert struct {
+	sync.WaitGroup
+	cert *cachedCert
+	err  error
+}
+
+var certCache *CertCache
+
+func NewCertCache(capacity int) *CertCache {
+	if capacity < 1 {
+		capacity = defaultCertCacheSize
+	}
+	return &CertCache{
+		entries:  make(map[string]*cachedCert),
+		capacity: capacity,
+		pending:  make(map[string]*pendingCert),
+	}
+}
+
+// certCacheKey builds a key from the requested hostname and the alternative names the certificate will contain
+func certCacheKey(hostname string, sans []string) string {
+	sorted := make([]string, len(sans))
+	for i, san := range sans {
+		sorted[i] = strings.ToLower(san)
+	}
+	sort.Strings(sorted)
+	return strings.ToLower(hostname) + " " + strings.Join(sorted, ",")
+}
+
+// GetOrCreate returns a cached certificate signed by ca, or calls create once for all concurrent callers of a key
+func (c *CertCache) GetOrCreate(key string, ca *x509.Certificate, create func() (*cachedCert, error)) (*cachedCert, error) {
+	c.Lock()
+	if entry, ok := c.entries[key]; ok {
+		if entry.ca == ca && time.Until(time.Unix(entry.ExpireDate, 0)) > certCacheMinRemaining {
+			c.touch(key)
+			c.Unlock()
+			return entry, nil
+		}
+		c.remove(key)
+	}
+	if pending, ok := c.pending[key]; ok {
+		c.Unlock()
+		pending.Wait()
+		return pending.cert, pending.err
+	}
+	pending := &pendingCert{}
+	pending.Add(1)
+	c.pending[key] = pending
+	c.Unlock()
+
+	pending.cert, pending.err = create()
+	if pending.err == nil {
+		pending.cert.ca = ca
+	}
+
+	c.Lock()
+	delete(c.pending, key)
+	if pending.err == nil {
+		c.put(key, pending.cert)
+	}
+	c.Unlock()
+	pending.Done()
+
+	return pending.cert, pending.err
+}
+
+func (c *CertCache) put(key string, entry *cachedCert) {
+	if _, exists := c.entries[key]; exists {
+		c.removeKey(key)
+	}
+	// evict least recently used
+	if len(c.keys) >= c.capacity {
+		delete(c.entries, c.keys[0])
+		c.keys = c.keys[1:]
+	}
+	c.entries[key] = entry
+	c.keys = append(c.keys, key)
+}
+
+func (c *CertCache) touch(key string) {
+	c.removeKey(key)
+	c.keys = append(c.keys, key)
+}
+
+func (c *CertCache) remove(key string) {
+	delete(c.entries, key)
+	c.removeKey(key)
+}
+
+func (c *CertCache) removeKey(key string) {
+	for i, existing := range c.keys {
+		if existing == key {
+			c.keys = append(c.keys[:i], c.keys[i+1:]...)
+			return
+		}
+	}
+}
+
+// Save writes the cache in least to most recently used order. It contains private keys of mirrored certificates.
+func (c *CertCache) Save(path string) error {
+	c.Lock()
+	persisted := make([]persistedCert, 0, len(c.keys))
+	for _, key := range c.keys {
+		entry := c.entries[key]
+		persisted = append(persisted, persistedCert{
+			Key:        key,
+			Cert:       entry.Cert,
+			PrivateKey: entry.PrivateKey,
+			ExpireDate: entry.ExpireDate,
+		})
+	}
+	certsJson, err := json.Marshal(persisted)
+	c.Unlock()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, certsJson, 0600)
+}
+
+type persistedCert struct {
+	Key        string
+	Cert       []byte
+	PrivateKey string
+	ExpireDate int64
+}
+
+// Load restores certificates that were signed by the current CA (and use the current leaf key)
+func (c *CertCache) Load(path string, config *CertConfig) error {
+	certsJson, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var persisted []persistedCert
+	err = json.Unmarshal(certsJson, &persisted)
+	if err != nil {
+		return err
+	}
+
+	ca, _, _ := config.authority()
+	c.Lock()
+	defer c.Unlock()
+	for _, entry := range persisted {
+		block, _ := pem.Decode(entry.Cert)
+		if block == nil {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil || cert.CheckSignatureFrom(ca) != nil {
+			continue
+		}
+		// the revocation server listens on another address (or was disabled)
+		var revocationUrls x509.Certificate
+		config.addRevocationUrls(&revocationUrls, ca)
+		if !sameNames(cert.OCSPServer, revocationUrls.OCSPServer) || !sameNames(cert.CRLDistributionPoints, revocationUrls.CRLDistributionPoints) {
+			continue
+		}
+		if entry.PrivateKey == "" {
+			publicKey, ok := cert.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+			if !ok || !publicKey.Equal(config.publicKey) {
+				continue
+			}
+		}
+		c.put(entry.Key, &cachedCert{
+			Cert:       entry.Cert,
+			PrivateKey: entry.PrivateKey,
+			ExpireDate: entry.ExpireDate,
+			ca:         ca,
+		})
+	}
+	return nil
+}
+
+// RemoveSerialNumber drops a certificate from the cache (eg, after it was revoked)
+func (c *CertCache) RemoveSerialNumber(serialNumber *big.Int) {
+	c.Lock()
+	defer c.Unlock()
+	for key, entry := range c.entries {
+		block, _ := pem.Decode(entry.Cert)
+		if block == nil {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err == nil && cert.SerialNumber.Cmp(serialNumber) == 0 {
+			c.remove(key)
+		}
+	}
+}
+
+// WarmupCertCache generates certificates for hosts that are likely to be requested (eg, from a previous session)
+func (c *CertConfig) WarmupCertCache(hosts []string) {
+	for _, host := range hosts {
+		_, err := c.CachedCert(host)
+		if err != nil {
+			SendErrorToIpc(0, "certCacheWarmup", err)
+		}
+	}
+}
+
+// CachedCert returns a certificate for hostname, using certCache when enabled
+func (c *CertConfig) CachedCert(hostname string) (*cachedCert, error) {
+	create := func() (*cachedCert, error) {
+		cert, expireDate, err := c.CreateCert(hostname)
+		if err != nil {
+			return nil, err
+		}
+		return &cachedCert{Cert: cert, ExpireDate: expireDate}, nil
+	}
+	if certCache == nil {
+		return create()
+	}
+	ca, _, _ := c.authority()
+	return certCache.GetOrCreate(certCacheKey(hostname, []string{hostname}), ca, create)
+}
+
+// CachedMirrorCert returns a mirrored certificate for an upstream certificate, using certCache when enabled
+func (c *CertConfig) CachedMirrorCert(hostname string, upstreamPEM string) (*cachedCert, error) {
+	create := func() (*cachedCert, error) {
+		cert, privateKey, expireDate, err := c.MirrorCert(hostname, upstreamPEM)
+		if err != nil {
+			return nil, err
+		}
+		return &cachedCert{Cert: cert, PrivateKey: privateKey, ExpireDate: expireDate}, nil
+	}
+	if certCache == nil {
+		return create()
+	}
+
+	block, _ := pem.Decode([]byte(upstreamPEM))
+	if block == nil {
+		return create()
+	}
+	upstream, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return create()
+	}
+	keyType, err := keyTypeOf(upstream.PublicKey)
+	if err != nil {
+		return create()
+	}
+	sans := append([]string{}, upstream.DNSNames...)
+	for _, ip := range upstream.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	// mirrored certificates use a key per key type, so the key type is part of the cache key
+	ca, _, _ := c.authority()
+	return certCache.GetOrCreate(certCacheKey(hostname, sans)+" mirror:"+keyType, ca, create)
+}
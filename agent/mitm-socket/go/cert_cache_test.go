@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingCreate returns a create function for GetOrCreate that counts its calls
+func countingCreate(calls *atomic.Int32, release <-chan struct{}) func() (*cachedCert, error) {
+	return func() (*cachedCert, error) {
+		calls.Add(1)
+		if release != nil {
+			<-release
+		}
+		return &cachedCert{Cert: []byte("cert"), ExpireDate: time.Now().AddDate(1, 0, 0).Unix()}, nil
+	}
+}
+
+func TestCertCacheCoalescesConcurrentRequests(t *testing.T) {
+	cache := NewCertCache(10)
+	ca := newTestCertConfig(t, nil).ca
+	var calls atomic.Int32
+	release := make(chan struct{})
+	create := countingCreate(&calls, release)
+
+	results := make([]*cachedCert, 20)
+	var waiters sync.WaitGroup
+	for i := range results {
+		waiters.Add(1)
+		go func() {
+			defer waiters.Done()
+			result, err := cache.GetOrCreate("coalesced.example.com", ca, create)
+			if err != nil {
+				t.Error(err)
+			}
+			results[i] = result
+		}()
+	}
+	// let the waiters queue up behind the first request
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	waiters.Wait()
+
+	if calls.Load() != 1 {
+		t.Fatalf("expected one certificate to be created, got %d", calls.Load())
+	}
+	for _, result := range results {
+		if result != results[0] {
+			t.Fatal("expected every waiter to get the same certificate")
+		}
+	}
+
+	// errors are returned to the waiters, but not cached
+	var failures atomic.Int32
+	failing := func() (*cachedCert, error) {
+		failures.Add(1)
+		return nil, errors.New("signing failed")
+	}
+	for range 2 {
+		if _, err := cache.GetOrCreate("failing.example.com", ca, failing); err == nil {
+			t.Fatal("expected the create error")
+		}
+	}
+	if failures.Load() != 2 {
+		t.Fatalf("expected failures to be retried, got %d calls", failures.Load())
+	}
+}
+
+func TestCertCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := NewCertCache(2)
+	ca := newTestCertConfig(t, nil).ca
+	var calls atomic.Int32
+	create := countingCreate(&calls, nil)
+
+	for _, key := range []string{"a", "b", "a", "c"} {
+		if _, err := cache.GetOrCreate(key, ca, create); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls.Load() != 3 {
+		t.Fatalf("expected a cached entry to be reused, got %d calls", calls.Load())
+	}
+	// a was used after b, so b was evicted for c
+	for key, expectedCalls := range map[string]int32{"a": 3, "c": 3} {
+		if _, err := cache.GetOrCreate(key, ca, create); err != nil || calls.Load() != expectedCalls {
+			t.Fatalf("expected %s to be cached, got %d calls", key, calls.Load())
+		}
+	}
+	if _, err := cache.GetOrCreate("b", ca, create); err != nil || calls.Load() != 4 {
+		t.Fatalf("expected b to be evicted, got %d calls", calls.Load())
+	}
+}
+
+func TestCertCacheInvalidatedByCaChanges(t *testing.T) {
+	sent := captureIpc(t)
+	config, err := NewCertConfig(t.TempDir(), nil, nil, KeyTypeEcdsaP256, KeyTypeEcdsaP256, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setTestGlobal(t, &certCache, NewCertCache(10))
+
+	first, err := config.CachedCert("rotated.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached, err := config.CachedCert("ROTATED.example.com"); err != nil || cached != first {
+		t.Fatal("expected the certificate to be cached")
+	}
+
+	if err = config.CheckAuthorityExpiry(0, 400); err != nil || len(sent()) != 1 {
+		t.Fatalf("expected the CA to be rotated: %v", err)
+	}
+	second, err := config.CachedCert("rotated.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == first || parseLeaf(t, second.Cert).CheckSignatureFrom(config.ca) != nil {
+		t.Fatal("expected a certificate from the rotated CA")
+	}
+
+	// certificates about to expire are generated again
+	var calls atomic.Int32
+	expiring := func() (*cachedCert, error) {
+		calls.Add(1)
+		return &cachedCert{Cert: []byte("cert"), ExpireDate: time.Now().Add(time.Hour).Unix()}, nil
+	}
+	for range 2 {
+		if _, err = certCache.GetOrCreate("expiring.example.com", config.ca, expiring); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("expected an expiring certificate to be replaced, got %d calls", calls.Load())
+	}
+}
+
+func TestCertCacheSaveAndLoad(t *testing.T) {
+	dir := t.TempDir()
+	config, err := NewCertConfig(dir, nil, nil, KeyTypeEcdsaP256, KeyTypeEcdsaP256, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setTestGlobal(t, &certCache, NewCertCache(10))
+
+	leaf, err := config.CachedCert("saved.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstreamKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstreamPEM := selfSignedPEM(t, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mirrored.example.com"},
+		DNSNames:     []string{"mirrored.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(0, 1, 0),
+	}, upstreamKey)
+	mirrored, err := config.CachedMirrorCert("mirrored.example.com", upstreamPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mirrored.PrivateKey == "" {
+		t.Fatal("expected the mirrored certificate to have its own key")
+	}
+
+	path := filepath.Join(dir, "certs.json")
+	if err = certCache.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restart with the same storage dir reuses the CA and leaf key
+	restarted, err := NewCertConfig(dir, nil, nil, KeyTypeEcdsaP256, KeyTypeEcdsaP256, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setTestGlobal(t, &certCache, NewCertCache(10))
+	if err = certCache.Load(path, restarted); err != nil {
+		t.Fatal(err)
+	}
+	loadedLeaf, err := restarted.CachedCert("saved.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(loadedLeaf.Cert, leaf.Cert) {
+		t.Fatal("expected the saved certificate to be loaded")
+	}
+	loadedMirror, err := restarted.CachedMirrorCert("mirrored.example.com", upstreamPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(loadedMirror.Cert, mirrored.Cert) || loadedMirror.PrivateKey != mirrored.PrivateKey {
+		t.Fatal("expected the mirrored certificate to be loaded with its key")
+	}
+
+	// certificates of another CA are skipped
+	setTestGlobal(t, &certCache, NewCertCache(10))
+	if err = certCache.Load(path, newTestCertConfig(t, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if len(certCache.entries) != 0 {
+		t.Fatalf("expected no certificates from another CA, got %d", len(certCache.entries))
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+)
+
+const (
+	KeyTypeRsa2048   = "rsa-2048"
+	KeyTypeRsa3072   = "rsa-3072"
+	KeyTypeRsa4096   = "rsa-4096"
+	KeyTypeEcdsaP256 = "ecdsa-p256"
+	KeyTypeEcdsaP384 = "ecdsa-p384"
+	KeyTypeEd25519   = "ed25519"
+)
+
+func generateKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case KeyTypeRsa2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeyTypeRsa3072:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case KeyTypeRsa4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case KeyTypeEcdsaP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeEcdsaP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyTypeEd25519:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	}
+	return nil, fmt.Errorf("Unsupported key type %s", keyType)
+}
+
+// keyTypeOf returns the closest supported key type for a public key (eg, an upstream certificate's key)
+func keyTypeOf(pub crypto.PublicKey) (string, error) {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		bits := key.N.BitLen()
+		if bits > 3072 {
+			return KeyTypeRsa4096, nil
+		}
+		if bits > 2048 {
+			return KeyTypeRsa3072, nil
+		}
+		return KeyTypeRsa2048, nil
+	case *ecdsa.PublicKey:
+		if key.Curve == elliptic.P256() {
+			return KeyTypeEcdsaP256, nil
+		}
+		// chrome doesn't support P-521, so fall back to the next strongest curve
+		return KeyTypeEcdsaP384, nil
+	case ed25519.PublicKey:
+		return KeyTypeEd25519, nil
+	}
+	return "", fmt.Errorf("Unsupported public key %T", pub)
+}
+
+// keyUsageFor returns the leaf key usages for a key. Key encipherment only applies to RSA (tls 1.2 rsa key exchange).
+func keyUsageFor(pub crypto.PublicKey) x509.KeyUsage {
+	if _, ok := pub.(*rsa.PublicKey); ok {
+		return x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature
+	}
+	return x509.KeyUsageDigitalSignature
+}
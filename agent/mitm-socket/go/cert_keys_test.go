@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestGenerateKeyTypes(t *testing.T) {
+	for _, keyType := range []string{KeyTypeRsa2048, KeyTypeRsa3072, KeyTypeRsa4096, KeyTypeEcdsaP256, KeyTypeEcdsaP384, KeyTypeEd25519} {
+		key, err := generateKey(keyType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if roundTrip, err := keyTypeOf(key.Public()); err != nil || roundTrip != keyType {
+			t.Fatalf("expected %s to be detected as itself, got %s %v", keyType, roundTrip, err)
+		}
+		_, isRsa := key.(*rsa.PrivateKey)
+		if usage := keyUsageFor(key.Public()); (usage&x509.KeyUsageKeyEncipherment != 0) != isRsa {
+			t.Fatalf("expected key encipherment only for rsa keys, got %d for %s", usage, keyType)
+		}
+	}
+
+	if _, err := generateKey("dsa-1024"); err == nil {
+		t.Fatal("expected an unsupported key type to fail")
+	}
+}
+
+func TestKeyTypeOfUsesClosestSupportedType(t *testing.T) {
+	p521Key, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed25519Key, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name    string
+		key     any
+		keyType string
+	}{
+		{"p-521", &p521Key.PublicKey, KeyTypeEcdsaP384},
+		{"rsa-1024", &rsa.PublicKey{N: new(big.Int).Lsh(big.NewInt(1), 1023), E: 65537}, KeyTypeRsa2048},
+		{"rsa-8192", &rsa.PublicKey{N: new(big.Int).Lsh(big.NewInt(1), 8191), E: 65537}, KeyTypeRsa4096},
+		{"ed25519", ed25519Key, KeyTypeEd25519},
+	} {
+		keyType, err := keyTypeOf(test.key)
+		if err != nil || keyType != test.keyType {
+			t.Fatalf("%s: expected %s, got %s %v", test.name, test.keyType, keyType, err)
+		}
+	}
+
+	if _, err = keyTypeOf("not a key"); err == nil {
+		t.Fatal("expected an unsupported public key to fail")
+	}
+}
+
+// the node side reads leaf keys as "PRIVATE KEY" (PKCS #8) pem, whatever the key type
+func TestLeafPrivateKeysArePkcs8Pem(t *testing.T) {
+	config, err := NewCertConfig(t.TempDir(), nil, nil, KeyTypeEcdsaP256, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := parsePkcs8Pem(t, config.privateKeyPEM).(*rsa.PrivateKey); !ok {
+		t.Fatal("expected the default leaf key to be rsa")
+	}
+
+	upstreamKey, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "p521.example.com"},
+		DNSNames:     []string{"p521.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	_, mirroredKeyPEM, _, err := config.MirrorCert("p521.example.com", selfSignedPEM(t, upstream, upstreamKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mirroredKey, ok := parsePkcs8Pem(t, mirroredKeyPEM).(*ecdsa.PrivateKey)
+	if !ok || mirroredKey.Curve != elliptic.P384() {
+		t.Fatalf("expected a P-521 upstream to be mirrored with a P-384 key, got %T", mirroredKey)
+	}
+}
+
+func parsePkcs8Pem(t *testing.T, keyPEM string) any {
+	t.Helper()
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil || block.Type != "PRIVATE KEY" {
+		t.Fatalf("expected a PRIVATE KEY pem block, got %v", block)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
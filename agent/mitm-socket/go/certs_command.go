@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	gopkcs12 "software.sslmate.com/src/go-pkcs12"
+)
+
+const certsCommandUsage = `Usage:
+  connect certs export --format pem|der|p12|nss [options]
+
+Writes the CA from the cert storage dir (created if missing) so it can be installed as a trusted root. A CA
+certificate from --ca-cert, or a CA with its key on a PKCS#11 token (--pkcs11-module), is exported instead of the
+cert storage dir CA.
+  pem  CA certificate (and key with --include-key) to --out or stdout
+  der  CA certificate to --out or stdout (and the key to --key-out)
+  p12  PKCS#12 trust store, or a CA identity with --include-key
+  nss  adds the CA to the NSS database in --out (eg, ~/.pki/nssdb or a Firefox profile). Needs certutil (libnss3-tools).
+`
+
+// RunCertsCommand handles the `certs` subcommands. Returns an error for invalid arguments.
+func RunCertsCommand(args []string) error {
+	if len(args) == 0 || args[0] != "export" {
+		return errors.New(certsCommandUsage)
+	}
+
+	flags := flag.NewFlagSet("certs export", flag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprint(flags.Output(), certsCommandUsage, "\nOptions:\n"); flags.PrintDefaults() }
+	format := flags.String("format", "pem", "pem, der, p12 or nss")
+	storageDir := flags.String("dir", "", "cert storage dir with ca.der and caKey.der (defaults to the working directory)")
+	keyType := flags.String("key-type", "", "key type of the CA if one is generated (defaults to rsa-2048)")
+	out := flags.String("out", "", "output file (nss: database directory). Defaults to stdout.")
+	includeKey := flags.Bool("include-key", false, "include the CA private key (pem and p12)")
+	keyOut := flags.String("key-out", "", "der: file to write the CA private key to")
+	password := flags.String("password", "", "p12 password")
+	legacy := flags.Bool("legacy", false, "p12: use 3DES encryption for older clients (eg, macOS keychain before 14)")
+	nickname := flags.String("nickname", "Unblocked", "nss: nickname of the certificate")
+	caCertPath := flags.String("ca-cert", "", "PEM or DER CA certificate to export (the CaCertPath session arg)")
+	pkcs11Config := &Pkcs11Config{}
+	flags.StringVar(&pkcs11Config.ModulePath, "pkcs11-module", "", "PKCS#11 module library of a token with the CA key (the CaPkcs11 session arg)")
+	flags.StringVar(&pkcs11Config.TokenLabel, "pkcs11-token", "", "PKCS#11 token label")
+	flags.StringVar(&pkcs11Config.KeyLabel, "pkcs11-key-label", "", "PKCS#11 label of the CA key")
+	flags.StringVar(&pkcs11Config.KeyId, "pkcs11-key-id", "", "PKCS#11 hex id of the CA key")
+	flags.StringVar(&pkcs11Config.PinEnv, "pkcs11-pin-env", "PKCS11_PIN", "environment variable with the PKCS#11 user pin")
+	if err := flags.Parse(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+
+	var ca *x509.Certificate
+	var caPrivateKey crypto.Signer
+	var err error
+	switch {
+	case pkcs11Config.ModulePath != "":
+		if *storageDir != "" {
+			err = os.MkdirAll(*storageDir, 0700)
+			if err != nil {
+				return err
+			}
+		}
+		// a certificate that isn't on the token or in --ca-cert is created in the cert storage dir, like in certs mode
+		ca, _, err = loadPkcs11Authority(pkcs11Config, *caCertPath, *storageDir, nil)
+	case *caCertPath != "":
+		ca, err = readAuthorityCertificate(*caCertPath)
+	default:
+		ca, caPrivateKey, err = readOrCreateAuthority(*storageDir, *keyType)
+	}
+	if err != nil {
+		return err
+	}
+	if caPrivateKey == nil && (*includeKey || *keyOut != "") {
+		return errors.New("The CA key is not in the cert storage dir. Keys on a PKCS#11 token can't be exported.")
+	}
+
+	switch *format {
+	case "pem":
+		output := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})
+		if *includeKey {
+			keyDer, err := x509.MarshalPKCS8PrivateKey(caPrivateKey)
+			if err != nil {
+				return err
+			}
+			output = append(output, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})...)
+		}
+		return writeExport(*out, output)
+
+	case "der":
+		if *includeKey && *keyOut == "" {
+			return errors.New("der keys are written to a separate file. Use --key-out.")
+		}
+		if *keyOut != "" {
+			keyDer, err := x509.MarshalPKCS8PrivateKey(caPrivateKey)
+			if err != nil {
+				return err
+			}
+			err = os.WriteFile(*keyOut, keyDer, 0600)
+			if err != nil {
+				return err
+			}
+		}
+		return writeExport(*out, ca.Raw)
+
+	case "p12":
+		encoder := gopkcs12.Modern
+		if *legacy {
+			encoder = gopkcs12.LegacyDES
+		}
+		var pfx []byte
+		if *includeKey {
+			pfx, err = encoder.Encode(caPrivateKey, ca, nil, *password)
+		} else {
+			pfx, err = encoder.EncodeTrustStore([]*x509.Certificate{ca}, *password)
+		}
+		if err != nil {
+			return err
+		}
+		return writeExport(*out, pfx)
+
+	case "nss":
+		if *includeKey {
+			return errors.New("The CA key can't be exported to an NSS database")
+		}
+		if *out == "" {
+			return errors.New("nss exports need the database directory in --out")
+		}
+		return addToNssDatabase(*out, *nickname, ca)
+	}
+	return fmt.Errorf("Unsupported export format %s", *format)
+}
+
+// readAuthorityCertificate reads a CA certificate without its key
+func readAuthorityCertificate(file string) (*x509.Certificate, error) {
+	certBytes, err := readPemOrDer(file)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(certBytes)
+}
+
+// readOrCreateAuthority uses the CA on disk as-is. NewAuthority would replace a CA with other name constraints.
+// A CA is only generated in a storage dir without a CA key, so a key without its certificate is an error.
+func readOrCreateAuthority(storageDir string, keyType string) (*x509.Certificate, crypto.Signer, error) {
+	ca, err := readCertFromDisk(filepath.Join(storageDir, "ca.der"))
+	if errors.Is(err, os.ErrNotExist) {
+		if _, err := os.Stat(filepath.Join(storageDir, "caKey.der")); err == nil {
+			return nil, nil, fmt.Errorf("The cert storage dir %q has a CA key without ca.der", storageDir)
+		}
+		if storageDir != "" {
+			err = os.MkdirAll(storageDir, 0700)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		fmt.Fprintf(os.Stderr, "Generating a new CA in %q. Use --ca-cert or --pkcs11-module to export a CA from elsewhere.\n", storageDir)
+		return NewAuthority(storageDir, keyType, nil)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	caPrivateKey, err := readPrivateKeyFromDisk(filepath.Join(storageDir, "caKey.der"), "")
+	// the key can be on a PKCS#11 token
+	if errors.Is(err, os.ErrNotExist) {
+		return ca, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return ca, caPrivateKey, nil
+}
+
+func writeExport(out string, data []byte) error {
+	if out == "" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(out, data, 0600)
+}
+
+// addToNssDatabase trusts the CA for tls servers in an sqlite NSS database (cert9.db), creating it if needed
+func addToNssDatabase(dir string, nickname string, ca *x509.Certificate) error {
+	certutil, err := exec.LookPath("certutil")
+	if err != nil {
+		return errors.New("The nss format needs certutil, which is not in PATH. Install the NSS tools (eg, apt install libnss3-tools)")
+	}
+	db := "sql:" + dir
+
+	if _, err := os.Stat(filepath.Join(dir, "cert9.db")); errors.Is(err, os.ErrNotExist) {
+		err = os.MkdirAll(dir, 0700)
+		if err != nil {
+			return err
+		}
+		err = runCertutil(certutil, "-N", "-d", db, "--empty-password")
+		if err != nil {
+			return err
+		}
+	}
+
+	// replace a previous (eg, rotated) CA with the same nickname
+	_ = runCertutil(certutil, "-D", "-d", db, "-n", nickname)
+
+	caFile, err := os.CreateTemp("", "ca-*.der")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(caFile.Name())
+	_, err = caFile.Write(ca.Raw)
+	caFile.Close()
+	if err != nil {
+		return err
+	}
+	return runCertutil(certutil, "-A", "-d", db, "-n", nickname, "-t", "C,,", "-i", caFile.Name())
+}
+
+func runCertutil(certutil string, args ...string) error {
+	cmd := exec.Command(certutil, args...)
+	var output strings.Builder
+	cmd.Stdout = io.Discard
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("certutil %s failed (%s) %s", args[0], err, strings.TrimSpace(output.String()))
+	}
+	return nil
+}
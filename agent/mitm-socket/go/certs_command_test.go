@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/pem"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	gopkcs12 "software.sslmate.com/src/go-pkcs12"
+)
+
+func TestExportRefusesCaKeyWithoutCertificate(t *testing.T) {
+	storageDir := t.TempDir()
+	if _, _, err := NewAuthority(storageDir, KeyTypeEcdsaP256, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(storageDir, "ca.der")); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(t.TempDir(), "ca.pem")
+	if err := RunCertsCommand([]string{"export", "--dir", storageDir, "--out", out}); err == nil {
+		t.Fatal("expected a storage dir with only a CA key to fail")
+	}
+	if _, err := os.Stat(filepath.Join(storageDir, "ca.der")); !os.IsNotExist(err) {
+		t.Fatal("expected no new CA to be generated")
+	}
+}
+
+func TestExportCaCertificate(t *testing.T) {
+	config := newTestCertConfig(t, nil)
+	caFile := filepath.Join(t.TempDir(), "ca.der")
+	if err := os.WriteFile(caFile, config.ca.Raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+	storageDir := t.TempDir()
+	out := filepath.Join(t.TempDir(), "exported.der")
+	err := RunCertsCommand([]string{"export", "--format", "der", "--dir", storageDir, "--ca-cert", caFile, "--out", out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported, err := readCertFromDisk(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exported.Equal(config.ca) {
+		t.Fatal("expected the --ca-cert CA to be exported")
+	}
+	if _, err = os.Stat(filepath.Join(storageDir, "ca.der")); !os.IsNotExist(err) {
+		t.Fatal("expected no CA to be generated in the storage dir")
+	}
+	if err = RunCertsCommand([]string{"export", "--ca-cert", caFile, "--include-key"}); err == nil {
+		t.Fatal("expected exporting a key that isn't available to fail")
+	}
+}
+
+func TestExportFormats(t *testing.T) {
+	storageDir := t.TempDir()
+	out := filepath.Join(t.TempDir(), "ca.p12")
+	err := RunCertsCommand([]string{"export", "--format", "p12", "--dir", storageDir, "--key-type", "ecdsa-p256", "--password", "secret", "--out", out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := readCertFromDisk(filepath.Join(storageDir, "ca.der"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pfx, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err := gopkcs12.DecodeTrustStore(pfx, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 || !certs[0].Equal(ca) {
+		t.Fatal("expected the CA in the PKCS#12 trust store")
+	}
+}
+
+func TestExportNssDatabase(t *testing.T) {
+	certutil, err := exec.LookPath("certutil")
+	if err != nil {
+		t.Skip("certutil (libnss3-tools) is not installed")
+	}
+	storageDir := t.TempDir()
+	nssDir := filepath.Join(t.TempDir(), "nssdb")
+	args := []string{"export", "--format", "nss", "--dir", storageDir, "--key-type", "ecdsa-p256", "--out", nssDir, "--nickname", "Test CA"}
+	// the second export replaces the certificate with the same nickname
+	for range 2 {
+		if err = RunCertsCommand(args); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = os.Stat(filepath.Join(nssDir, "cert9.db")); err != nil {
+		t.Fatal(err)
+	}
+
+	exported, err := exec.Command(certutil, "-L", "-d", "sql:"+nssDir, "-n", "Test CA", "-a").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := readCertFromDisk(filepath.Join(storageDir, "ca.der"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, rest := pem.Decode(exported)
+	if block == nil || !bytes.Equal(block.Bytes, ca.Raw) || bytes.Contains(rest, []byte("CERTIFICATE")) {
+		t.Fatalf("expected the CA once in the NSS database, got %s", exported)
+	}
+	listed, err := exec.Command(certutil, "-L", "-d", "sql:"+nssDir).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`Test CA\s+C,,`).Match(listed) {
+		t.Fatalf("expected the CA to be trusted for tls servers, got %s", listed)
+	}
+}
+
+func TestExportNssNeedsCertutil(t *testing.T) {
+	storageDir := t.TempDir()
+	nssDir := t.TempDir()
+	t.Setenv("PATH", t.TempDir())
+
+	err := RunCertsCommand([]string{"export", "--format", "nss", "--dir", storageDir, "--key-type", "ecdsa-p256", "--out", nssDir})
+	if err == nil || !strings.Contains(err.Error(), "needs certutil") {
+		t.Fatalf("expected an error about the missing certutil, got %v", err)
+	}
+	if err = RunCertsCommand([]string{"export", "--format", "nss", "--dir", storageDir}); err == nil {
+		t.Fatal("expected nss exports without a database directory to fail")
+	}
+	if err = RunCertsCommand([]string{"export", "--format", "nss", "--dir", storageDir, "--out", nssDir, "--include-key"}); err == nil {
+		t.Fatal("expected exporting the key to an NSS database to fail")
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	tls "github.com/refraction-networking/utls"
+	gopkcs12 "software.sslmate.com/src/go-pkcs12"
+)
+
+// ClientCertificateDefinition is a client certificate presented when an upstream server requests one (mutual tls).
+// Provide either a PEM certificate chain + key, or a PKCS#12 bundle.
+type ClientCertificateDefinition struct {
+	CertPem string
+	KeyPem  string
+	// base64 encoded PKCS#12 (.p12/.pfx)
+	Pkcs12         string
+	Pkcs12Password string
+}
+
+// UsedClientCertificate describes the certificate that was sent to the server
+type UsedClientCertificate struct {
+	Subject           string
+	Issuer            string
+	SerialNumber      string
+	Sha256Fingerprint string
+}
+
+// client certificates from SessionArgs, keyed by host (see findByHost)
+var sessionClientCertificates map[string]*tls.Certificate
+
+func InitClientCertificates(sessionArgs SessionArgs) error {
+	certificates := make(map[string]*tls.Certificate)
+	for host, definition := range sessionArgs.ClientCertificates {
+		certificate, err := definition.ToCertificate()
+		if err != nil {
+			return fmt.Errorf("Invalid client certificate for %s (%s)", host, err)
+		}
+		certificates[strings.ToLower(host)] = certificate
+	}
+	sessionClientCertificates = certificates
+	return nil
+}
+
+// GetClientCertificate returns the certificate configured for a connection. ConnectArgs take precedence over
+// the session host map.
+func GetClientCertificate(connectArgs ConnectArgs) (*tls.Certificate, error) {
+	if connectArgs.ClientCertificate != nil {
+		return connectArgs.ClientCertificate.ToCertificate()
+	}
+
+	certificate, _ := findByHost(sessionClientCertificates, connectHost(connectArgs))
+	return certificate, nil
+}
+
+func (definition *ClientCertificateDefinition) ToCertificate() (*tls.Certificate, error) {
+	certPem := []byte(definition.CertPem)
+	keyPem := []byte(definition.KeyPem)
+
+	if definition.Pkcs12 != "" {
+		pfx, err := base64.StdEncoding.DecodeString(definition.Pkcs12)
+		if err != nil {
+			return nil, err
+		}
+		privateKey, leaf, chain, err := gopkcs12.DecodeChain(pfx, definition.Pkcs12Password)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read PKCS#12 (%s)", err)
+		}
+		key, ok := privateKey.(crypto.Signer)
+		if !ok {
+			return nil, errors.New("Unsupported PKCS#12 private key")
+		}
+		if publicKey, ok := leaf.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); !ok || !publicKey.Equal(key.Public()) {
+			return nil, errors.New("The PKCS#12 private key doesn't match the certificate")
+		}
+		// the leaf has to be sent first
+		certificate := &tls.Certificate{Certificate: [][]byte{leaf.Raw}, PrivateKey: key, Leaf: leaf}
+		for _, cert := range chain {
+			certificate.Certificate = append(certificate.Certificate, cert.Raw)
+		}
+		return certificate, nil
+	}
+
+	if len(certPem) == 0 || len(keyPem) == 0 {
+		return nil, errors.New("A client certificate needs a certificate and a private key")
+	}
+
+	certificate, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		return nil, err
+	}
+	certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &certificate, nil
+}
+
+func describeClientCertificate(certificate *tls.Certificate) *UsedClientCertificate {
+	fingerprint := sha256.Sum256(certificate.Certificate[0])
+	return &UsedClientCertificate{
+		Subject:           certificate.Leaf.Subject.String(),
+		Issuer:            certificate.Leaf.Issuer.String(),
+		SerialNumber:      certificate.Leaf.SerialNumber.String(),
+		Sha256Fingerprint: hex.EncodeToString(fingerprint[:]),
+	}
+}
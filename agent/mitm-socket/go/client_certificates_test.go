@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"testing"
+
+	gopkcs12 "software.sslmate.com/src/go-pkcs12"
+)
+
+func TestClientCertificateFromModernPkcs12(t *testing.T) {
+	config := newTestCertConfig(t, nil)
+	certPEM, _, err := config.CreateCert("client.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := parseLeaf(t, certPEM)
+	block, _ := pem.Decode([]byte(config.privateKeyPEM))
+	key, err := parsePrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pfx, err := gopkcs12.Modern.Encode(key, leaf, []*x509.Certificate{config.ca}, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	definition := &ClientCertificateDefinition{Pkcs12: base64.StdEncoding.EncodeToString(pfx), Pkcs12Password: "secret"}
+	certificate, err := definition.ToCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certificate.Certificate) != 2 || !bytes.Equal(certificate.Certificate[0], leaf.Raw) || !bytes.Equal(certificate.Certificate[1], config.ca.Raw) {
+		t.Fatal("expected the leaf followed by the CA")
+	}
+	if !certificate.Leaf.Equal(leaf) {
+		t.Fatal("expected the parsed leaf")
+	}
+
+	definition.Pkcs12Password = "wrong"
+	if _, err = definition.ToCertificate(); err == nil {
+		t.Fatal("expected a wrong password to fail")
+	}
+
+	// a key of another certificate
+	otherKey, err := generateKey(KeyTypeEcdsaP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pfx, err = gopkcs12.Modern.Encode(otherKey, leaf, nil, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	definition = &ClientCertificateDefinition{Pkcs12: base64.StdEncoding.EncodeToString(pfx), Pkcs12Password: "secret"}
+	if _, err = definition.ToCertificate(); err == nil {
+		t.Fatal("expected a mismatched key to fail")
+	}
+}
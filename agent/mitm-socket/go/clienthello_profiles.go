@@ -0,0 +1,80 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// Browser fingerprints that aren't available as utls presets are stored as ClientHelloDefinition json
+//
+//go:embed clienthellos/*.json
+var clientHelloProfiles embed.FS
+
+// ClientHelloProfile creates a new ClientHelloSpec for every connection
+type ClientHelloProfile interface {
+	ToSpec() (tls.ClientHelloSpec, error)
+}
+
+var loadedProfiles = make(map[string]ClientHelloProfile)
+var loadedProfilesMutex sync.Mutex
+
+// LoadClientHelloProfile looks for a named profile in the given directory, then in the embedded profiles.
+// A profile is either a ClientHelloDefinition (<name>.json) or a raw hex/base64 ClientHello capture (<name>.raw).
+func LoadClientHelloProfile(name string, dir string) (ClientHelloProfile, error) {
+	loadedProfilesMutex.Lock()
+	defer loadedProfilesMutex.Unlock()
+
+	cacheKey := filepath.Join(dir, name)
+	if profile, ok := loadedProfiles[cacheKey]; ok {
+		return profile, nil
+	}
+
+	var profile ClientHelloProfile
+	var err error
+	if dir != "" {
+		profile, err = readClientHelloProfile(name, func(file string) ([]byte, error) {
+			return os.ReadFile(filepath.Join(dir, file))
+		})
+	}
+	if profile == nil && err == nil {
+		profile, err = readClientHelloProfile(name, func(file string) ([]byte, error) {
+			return clientHelloProfiles.ReadFile("clienthellos/" + file)
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	if profile == nil {
+		return nil, fmt.Errorf("Unknown ClientHello profile %s", name)
+	}
+
+	loadedProfiles[cacheKey] = profile
+	return profile, nil
+}
+
+func readClientHelloProfile(name string, readFile func(file string) ([]byte, error)) (ClientHelloProfile, error) {
+	if profileJson, err := readFile(name + ".json"); err == nil {
+		definition := &ClientHelloDefinition{}
+		err = json.Unmarshal(profileJson, definition)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid ClientHello profile %s (%s)", name, err)
+		}
+		return definition, nil
+	}
+
+	if capture, err := readFile(name + ".raw"); err == nil {
+		raw, err := ParseRawClientHello(string(capture))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid raw ClientHello profile %s (%s)", name, err)
+		}
+		return raw, nil
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"strings"
+
+	tls "github.com/refraction-networking/utls"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// RawClientHello is a ClientHello captured off the wire (eg, by the double-agent tls-server). It can be a
+// full tls record, or just the handshake message.
+type RawClientHello []byte
+
+const recordTypeHandshake = 0x16
+const handshakeTypeClientHello = 0x01
+
+var hexSeparators = regexp.MustCompile(`[\s:]|0x`)
+var hexPattern = regexp.MustCompile(`^[0-9a-fA-F]+$`)
+
+// ParseRawClientHello accepts hex (optionally separated by whitespace or colons) or base64 encoded bytes
+func ParseRawClientHello(encoded string) (RawClientHello, error) {
+	var raw []byte
+	var err error
+
+	encoded = strings.TrimSpace(encoded)
+	cleaned := hexSeparators.ReplaceAllString(encoded, "")
+	if len(cleaned)%2 == 0 && hexPattern.MatchString(cleaned) {
+		raw, err = hex.DecodeString(cleaned)
+	} else {
+		raw, err = base64.StdEncoding.DecodeString(encoded)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(raw) < 4 {
+		return nil, errors.New("Raw ClientHello is too short")
+	}
+
+	if raw[0] == handshakeTypeClientHello {
+		// wrap a bare handshake message in a tls 1.0 record header
+		length := len(raw)
+		raw = append([]byte{recordTypeHandshake, 0x03, 0x01, byte(length >> 8), byte(length)}, raw...)
+	}
+
+	if raw[0] != recordTypeHandshake {
+		return nil, errors.New("Raw ClientHello is not a handshake record")
+	}
+
+	return RawClientHello(raw), nil
+}
+
+// ToSpec fingerprints the captured ClientHello. Unknown extensions are replayed byte for byte.
+func (raw RawClientHello) ToSpec() (tls.ClientHelloSpec, error) {
+	fingerprinter := &tls.Fingerprinter{
+		AllowBluntMimicry: true,
+		RealPSKResumption: true,
+	}
+	spec, err := fingerprinter.RawClientHello(raw)
+	if err != nil {
+		return tls.ClientHelloSpec{}, err
+	}
+
+	for _, ext := range spec.Extensions {
+		// utls pads boringssl style, based on the length of each hello. Other captures keep their padding length.
+		if padding, ok := ext.(*tls.UtlsPaddingExtension); ok {
+			unpaddedLen, paddingLen, found := raw.capturedPadding()
+			if boringLen, willPad := tls.BoringPaddingStyle(unpaddedLen); found && (!willPad || boringLen != paddingLen) {
+				padding.GetPaddingLen = nil
+				padding.PaddingLen = paddingLen
+				padding.WillPad = true
+			}
+		}
+	}
+
+	return *spec, nil
+}
+
+// capturedPadding returns the length of the captured handshake message without the padding extension, and the
+// length of the padding
+func (raw RawClientHello) capturedPadding() (int, int, bool) {
+	message := cryptobyte.String(raw[5:])
+	var body, sessionId, cipherSuites, compressionMethods, extensions cryptobyte.String
+	if !message.Skip(1) || !message.ReadUint24LengthPrefixed(&body) {
+		return 0, 0, false
+	}
+	messageLen := 4 + len(body)
+	if !body.Skip(2+32) || !body.ReadUint8LengthPrefixed(&sessionId) || !body.ReadUint16LengthPrefixed(&cipherSuites) ||
+		!body.ReadUint8LengthPrefixed(&compressionMethods) || !body.ReadUint16LengthPrefixed(&extensions) {
+		return 0, 0, false
+	}
+	for !extensions.Empty() {
+		var id uint16
+		var data cryptobyte.String
+		if !extensions.ReadUint16(&id) || !extensions.ReadUint16LengthPrefixed(&data) {
+			return 0, 0, false
+		}
+		if id == extensionPadding {
+			return messageLen - 4 - len(data), len(data), true
+		}
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"slices"
+	"strings"
+	"testing"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// captureClientHello returns a ClientHello handshake message built from the fingerprint test spec and extra
+// extensions
+func captureClientHello(t *testing.T, extensions ...tls.TLSExtension) []byte {
+	t.Helper()
+	spec := fingerprintTestSpec()
+	spec.Extensions = append(spec.Extensions[:len(spec.Extensions)-1], extensions...)
+	return buildClientHello(t, spec).HandshakeState.Hello.Raw
+}
+
+func TestParseRawClientHello(t *testing.T) {
+	message := captureClientHello(t)
+	record := append([]byte{recordTypeHandshake, 0x03, 0x01, byte(len(message) >> 8), byte(len(message))}, message...)
+	colonHex := strings.ToUpper(hex.EncodeToString(message[:1]))
+	for _, b := range message[1:] {
+		colonHex += ":" + hex.EncodeToString([]byte{b})
+	}
+
+	tests := []struct {
+		name    string
+		encoded string
+	}{
+		{"hex record", hex.EncodeToString(record)},
+		{"hex handshake", "\n" + hex.EncodeToString(message) + "\n"},
+		{"separated hex", colonHex},
+		{"0x prefixed hex", "0x" + hex.EncodeToString(record)},
+		{"base64 record", base64.StdEncoding.EncodeToString(record)},
+		{"base64 handshake", base64.StdEncoding.EncodeToString(message)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			raw, err := ParseRawClientHello(test.encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(raw, record) {
+				t.Fatalf("expected the tls record\n%x\n%x", raw, record)
+			}
+			spec, err := raw.ToSpec()
+			if err != nil {
+				t.Fatal(err)
+			}
+			captured, _ := parseClientHello(message)
+			replayed, err := parseClientHello(buildClientHello(t, &spec).HandshakeState.Hello.Raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(greaseIds(replayed.extensions), greaseIds(captured.extensions)) ||
+				!slices.Equal(greaseIds(replayed.cipherSuites), greaseIds(captured.cipherSuites)) {
+				t.Fatalf("expected the captured ClientHello to be replayed, got %v", replayed.extensions)
+			}
+		})
+	}
+}
+
+func TestParseMalformedRawClientHello(t *testing.T) {
+	message := captureClientHello(t)
+	tests := map[string]string{
+		"not hex or base64":   "not a ClientHello",
+		"too short":           "160301",
+		"not a handshake":     "17030100050102030405",
+		"odd hex with base64": "abc",
+	}
+	for name, encoded := range tests {
+		if _, err := ParseRawClientHello(encoded); err == nil {
+			t.Errorf("%s: expected %q to be rejected", name, encoded)
+		}
+	}
+
+	truncated, err := ParseRawClientHello(hex.EncodeToString(message[:len(message)/2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = truncated.ToSpec(); err == nil {
+		t.Fatal("expected a truncated ClientHello to be rejected")
+	}
+}
+
+func TestRawClientHelloPadding(t *testing.T) {
+	// pushes the hello into the 256-511 byte range boringssl pads
+	filler := &tls.GenericExtension{Id: 4660, Data: make([]byte, 100)}
+
+	boring, err := ParseRawClientHello(hex.EncodeToString(captureClientHello(t, filler, &tls.UtlsPaddingExtension{GetPaddingLen: tls.BoringPaddingStyle})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, paddingLen, found := boring.capturedPadding(); !found || paddingLen == 0 {
+		t.Fatal("expected the capture to be padded")
+	}
+	spec, err := boring.ToSpec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed := buildClientHello(t, &spec).HandshakeState.Hello.Raw
+	if len(replayed) != 512 {
+		t.Fatalf("expected boringssl padding to 512 bytes, got %d", len(replayed))
+	}
+
+	fixed, err := ParseRawClientHello(hex.EncodeToString(captureClientHello(t, filler, &tls.UtlsPaddingExtension{PaddingLen: 7, WillPad: true})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, err = fixed.ToSpec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if padding := clientHelloExtensionData(t, buildClientHello(t, &spec).HandshakeState.Hello.Raw, extensionPadding); len(padding) != 7 {
+		t.Fatalf("expected the captured padding length, got %d", len(padding))
+	}
+}
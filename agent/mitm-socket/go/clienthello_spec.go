@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// ClientHelloDefinition is a json description of a ClientHello. It can be sent in through SessionArgs
+// so new browser fingerprints can be shipped without recompiling this library.
+//
+// Any GREASE value (0x?a?a) in cipher suites, extension ids, groups, versions or key shares is replaced
+// with a freshly generated GREASE value for each connection.
+type ClientHelloDefinition struct {
+	TlsVersMin         uint16
+	TlsVersMax         uint16
+	CipherSuites       []uint16
+	CompressionMethods []uint8
+	Extensions         []ClientHelloExtensionDefinition
+	// shuffle extensions the way chrome 106+ does (GREASE, padding and psk keep their positions)
+	ShuffleExtensions bool
+}
+
+type ClientHelloExtensionDefinition struct {
+	Id uint16
+	// base64 encoded extension payload. Used as-is for extensions this library doesn't model. For
+	// encrypted_client_hello it sets the cipher suite and lengths of the GREASE extension.
+	Data string
+
+	// alpn, alps and npn
+	Protocols []string
+	// supported_versions
+	Versions []uint16
+	// supported_groups
+	Groups []uint16
+	// key_share
+	KeyShares []KeyShareDefinition
+	// signature_algorithms, signature_algorithms_cert and delegated_credentials
+	SignatureAlgorithms []uint16
+	// ec_point_formats
+	PointFormats []uint8
+	// psk_key_exchange_modes
+	PskModes []uint8
+	// compress_certificate
+	CertCompressionAlgorithms []uint16
+	// record_size_limit
+	RecordSizeLimit uint16
+	// padding: "boring" (default) or "fixed" (uses PaddingLength)
+	PaddingStyle  string
+	PaddingLength int
+}
+
+type KeyShareDefinition struct {
+	Group uint16
+	// base64 encoded key data. Leave empty to generate a key for the group (a single 0 byte for GREASE).
+	Data string
+}
+
+const (
+	extensionServerName              = 0
+	extensionStatusRequest           = 5
+	extensionSupportedGroups         = 10
+	extensionPointFormats            = 11
+	extensionSignatureAlgorithms     = 13
+	extensionALPN                    = 16
+	extensionPadding                 = 21
+	extensionCompressCertificate     = 27
+	extensionRecordSizeLimit         = 28
+	extensionDelegatedCredentials    = 34
+	extensionPreSharedKey            = 41
+	extensionSupportedVersions       = 43
+	extensionPskKeyExchangeModes     = 45
+	extensionSignatureAlgorithmsCert = 50
+	extensionKeyShare                = 51
+	extensionNextProtoNeg            = 13172
+	extensionApplicationSettings     = 17513
+	extensionApplicationSettingsNew  = 17613
+	extensionEncryptedClientHello    = 0xfe0d
+	extensionRenegotiationInfo       = 0xff01
+	paddingStyleFixed                = "fixed"
+)
+
+func isGreaseValue(value uint16) bool {
+	return value&0x0f0f == 0x0a0a && value>>8 == value&0xff
+}
+
+func greaseUint16(value uint16) uint16 {
+	if isGreaseValue(value) {
+		return tls.GREASE_PLACEHOLDER
+	}
+	return value
+}
+
+func decodeDefinitionData(data string) ([]byte, error) {
+	if data == "" {
+		return nil, nil
+	}
+	return base64.StdEncoding.DecodeString(data)
+}
+
+// ToSpec converts the definition into a utls ClientHelloSpec. A new spec must be created for each
+// connection since utls stores connection state in the extensions.
+func (definition *ClientHelloDefinition) ToSpec() (tls.ClientHelloSpec, error) {
+	spec := tls.ClientHelloSpec{
+		TLSVersMin:         definition.TlsVersMin,
+		TLSVersMax:         definition.TlsVersMax,
+		CompressionMethods: definition.CompressionMethods,
+	}
+	if len(spec.CompressionMethods) == 0 {
+		spec.CompressionMethods = []uint8{0x00}
+	}
+
+	for _, cipher := range definition.CipherSuites {
+		spec.CipherSuites = append(spec.CipherSuites, greaseUint16(cipher))
+	}
+
+	for _, extDefinition := range definition.Extensions {
+		ext, err := extDefinition.ToExtension()
+		if err != nil {
+			return spec, err
+		}
+		spec.Extensions = append(spec.Extensions, ext)
+	}
+
+	if definition.ShuffleExtensions {
+		spec.Extensions = tls.ShuffleChromeTLSExtensions(spec.Extensions)
+	}
+
+	return spec, nil
+}
+
+func (ext *ClientHelloExtensionDefinition) ToExtension() (tls.TLSExtension, error) {
+	data, err := decodeDefinitionData(ext.Data)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid data for ClientHello extension %d (%s)", ext.Id, err)
+	}
+
+	if isGreaseValue(ext.Id) {
+		return &tls.UtlsGREASEExtension{Body: data}, nil
+	}
+
+	switch ext.Id {
+	case extensionServerName:
+		return &tls.SNIExtension{}, nil
+	case extensionStatusRequest:
+		return &tls.StatusRequestExtension{}, nil
+	case extensionSupportedGroups:
+		curves := make([]tls.CurveID, len(ext.Groups))
+		for i, group := range ext.Groups {
+			curves[i] = tls.CurveID(greaseUint16(group))
+		}
+		return &tls.SupportedCurvesExtension{Curves: curves}, nil
+	case extensionPointFormats:
+		return &tls.SupportedPointsExtension{SupportedPoints: ext.PointFormats}, nil
+	case extensionSignatureAlgorithms:
+		return &tls.SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: ext.signatureSchemes()}, nil
+	case extensionSignatureAlgorithmsCert:
+		return &tls.SignatureAlgorithmsCertExtension{SupportedSignatureAlgorithms: ext.signatureSchemes()}, nil
+	case extensionDelegatedCredentials:
+		return &tls.FakeDelegatedCredentialsExtension{SupportedSignatureAlgorithms: ext.signatureSchemes()}, nil
+	case extensionALPN:
+		return &tls.ALPNExtension{AlpnProtocols: ext.Protocols}, nil
+	case extensionApplicationSettings:
+		return &tls.ApplicationSettingsExtension{SupportedProtocols: ext.Protocols}, nil
+	case extensionApplicationSettingsNew:
+		return &tls.ApplicationSettingsExtensionNew{SupportedProtocols: ext.Protocols}, nil
+	case extensionNextProtoNeg:
+		return &tls.NPNExtension{NextProtos: ext.Protocols}, nil
+	case extensionPadding:
+		if ext.PaddingStyle == paddingStyleFixed {
+			return &tls.UtlsPaddingExtension{PaddingLen: ext.PaddingLength, WillPad: true}, nil
+		}
+		return &tls.UtlsPaddingExtension{GetPaddingLen: tls.BoringPaddingStyle}, nil
+	case extensionCompressCertificate:
+		algorithms := make([]tls.CertCompressionAlgo, len(ext.CertCompressionAlgorithms))
+		for i, algorithm := range ext.CertCompressionAlgorithms {
+			algorithms[i] = tls.CertCompressionAlgo(algorithm)
+		}
+		return &tls.UtlsCompressCertExtension{Algorithms: algorithms}, nil
+	case extensionRecordSizeLimit:
+		return &tls.FakeRecordSizeLimitExtension{Limit: ext.RecordSizeLimit}, nil
+	case extensionPreSharedKey:
+		return &tls.UtlsPreSharedKeyExtension{}, nil
+	case extensionSupportedVersions:
+		versions := make([]uint16, len(ext.Versions))
+		for i, version := range ext.Versions {
+			versions[i] = greaseUint16(version)
+		}
+		return &tls.SupportedVersionsExtension{Versions: versions}, nil
+	case extensionPskKeyExchangeModes:
+		return &tls.PSKKeyExchangeModesExtension{Modes: ext.PskModes}, nil
+	case extensionKeyShare:
+		keyShares := make([]tls.KeyShare, len(ext.KeyShares))
+		for i, keyShare := range ext.KeyShares {
+			keyData, err := decodeDefinitionData(keyShare.Data)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid key share data for group %d (%s)", keyShare.Group, err)
+			}
+			// chrome sends a single byte for the GREASE key share
+			if keyData == nil && isGreaseValue(keyShare.Group) {
+				keyData = []byte{0}
+			}
+			keyShares[i] = tls.KeyShare{Group: tls.CurveID(greaseUint16(keyShare.Group)), Data: keyData}
+		}
+		return &tls.KeyShareExtension{KeyShares: keyShares}, nil
+	case extensionEncryptedClientHello:
+		if data == nil {
+			return tls.BoringGREASEECH(), nil
+		}
+		// keep the cipher suite and lengths of a captured outer extension. The key and payload are random.
+		ech := &tls.GREASEEncryptedClientHelloExtension{}
+		if _, err = ech.Write(data); err != nil {
+			return nil, fmt.Errorf("Invalid data for the encrypted_client_hello extension (%s)", err)
+		}
+		return ech, nil
+	case extensionRenegotiationInfo:
+		return &tls.RenegotiationInfoExtension{Renegotiation: tls.RenegotiateOnceAsClient}, nil
+	}
+
+	// fall back to the utls implementation for parameterless extensions (sct, session ticket, ems...)
+	if data == nil {
+		if known := tls.ExtensionFromID(ext.Id); known != nil {
+			return known, nil
+		}
+	}
+
+	// reproduce anything else byte for byte
+	return &tls.GenericExtension{Id: ext.Id, Data: data}, nil
+}
+
+func (ext *ClientHelloExtensionDefinition) signatureSchemes() []tls.SignatureScheme {
+	schemes := make([]tls.SignatureScheme, len(ext.SignatureAlgorithms))
+	for i, scheme := range ext.SignatureAlgorithms {
+		schemes[i] = tls.SignatureScheme(scheme)
+	}
+	return schemes
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"slices"
+	"testing"
+
+	tls "github.com/refraction-networking/utls"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+const chromeLikeDefinition = `{
+	"cipherSuites": [2570, 4865, 4866, 4867, 49195, 49199],
+	"extensions": [
+		{"id": 2570},
+		{"id": 0},
+		{"id": 23},
+		{"id": 65281},
+		{"id": 10, "groups": [6682, 29, 23, 24]},
+		{"id": 11, "pointFormats": [0]},
+		{"id": 16, "protocols": ["h2", "http/1.1"]},
+		{"id": 13, "signatureAlgorithms": [1027, 2052, 1025]},
+		{"id": 51, "keyShares": [{"group": 6682}, {"group": 29}]},
+		{"id": 45, "pskModes": [1]},
+		{"id": 43, "versions": [14906, 772, 771]},
+		{"id": 27, "certCompressionAlgorithms": [2]},
+		{"id": 17513, "protocols": ["h2"]},
+		{"id": 65037},
+		{"id": 4660, "data": "AQID"},
+		{"id": 35466}
+	]
+}`
+
+func parseTestDefinition(t *testing.T, definitionJson string) *ClientHelloDefinition {
+	t.Helper()
+	definition := &ClientHelloDefinition{}
+	if err := json.Unmarshal([]byte(definitionJson), definition); err != nil {
+		t.Fatal(err)
+	}
+	return definition
+}
+
+// greaseIds maps GREASE values to one placeholder so hellos can be compared with their definition
+func greaseIds(values []uint16) []uint16 {
+	mapped := make([]uint16, len(values))
+	for i, value := range values {
+		mapped[i] = greaseUint16(value)
+	}
+	return mapped
+}
+
+func TestClientHelloDefinitionRoundTrip(t *testing.T) {
+	shuffled := parseTestDefinition(t, chromeLikeDefinition)
+	shuffled.ShuffleExtensions = true
+	safari, err := LoadClientHelloProfile("safari13", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		definition *ClientHelloDefinition
+	}{
+		{"chrome like", parseTestDefinition(t, chromeLikeDefinition)},
+		{"shuffled", shuffled},
+		{"embedded profile", safari.(*ClientHelloDefinition)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spec, err := test.definition.ToSpec()
+			if err != nil {
+				t.Fatal(err)
+			}
+			hello, err := parseClientHello(buildClientHello(t, &spec).HandshakeState.Hello.Raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(greaseIds(hello.cipherSuites), greaseIds(test.definition.CipherSuites)) {
+				t.Fatalf("expected the cipher suites %v, got %v", test.definition.CipherSuites, hello.cipherSuites)
+			}
+
+			var expectedIds []uint16
+			for _, ext := range test.definition.Extensions {
+				expectedIds = append(expectedIds, ext.Id)
+			}
+			expectedIds, sentIds := greaseIds(expectedIds), greaseIds(hello.extensions)
+			if test.definition.ShuffleExtensions {
+				slices.Sort(expectedIds)
+				slices.Sort(sentIds)
+			}
+			if !slices.Equal(sentIds, expectedIds) {
+				t.Fatalf("expected the extensions %v, got %v", expectedIds, sentIds)
+			}
+		})
+	}
+}
+
+func TestClientHelloDefinitionExtensions(t *testing.T) {
+	spec, err := parseTestDefinition(t, chromeLikeDefinition).ToSpec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	uconn := buildClientHello(t, &spec)
+	hello, err := parseClientHello(uconn.HandshakeState.Hello.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(greaseIds(hello.supportedGroups), []uint16{tls.GREASE_PLACEHOLDER, 29, 23, 24}) {
+		t.Fatalf("unexpected supported groups %v", hello.supportedGroups)
+	}
+	if !slices.Equal(greaseIds(hello.supportedVersions), []uint16{tls.GREASE_PLACEHOLDER, tls.VersionTLS13, tls.VersionTLS12}) {
+		t.Fatalf("unexpected supported versions %v", hello.supportedVersions)
+	}
+	if !slices.Equal(hello.alpnProtocols, []string{"h2", "http/1.1"}) {
+		t.Fatalf("unexpected alpn %v", hello.alpnProtocols)
+	}
+
+	keyShares := uconn.HandshakeState.Hello.KeyShares
+	if len(keyShares) != 2 || !bytes.Equal(keyShares[0].Data, []byte{0}) || len(keyShares[1].Data) != 32 {
+		t.Fatalf("expected a one byte GREASE key share and an x25519 key, got %+v", keyShares)
+	}
+	if data := clientHelloExtensionData(t, uconn.HandshakeState.Hello.Raw, 4660); !bytes.Equal(data, []byte{1, 2, 3}) {
+		t.Fatalf("expected the extension data to be sent as-is, got %x", data)
+	}
+}
+
+func TestClientHelloDefinitionEchData(t *testing.T) {
+	// outer ClientHello, HKDF-SHA256/ChaCha20Poly1305, config 7, 32 byte key and a 160 byte payload
+	var captured cryptobyte.Builder
+	captured.AddUint8(0)
+	captured.AddUint16(0x0001)
+	captured.AddUint16(0x0003)
+	captured.AddUint8(7)
+	captured.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(make([]byte, 32)) })
+	captured.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(make([]byte, 160)) })
+	capturedData := captured.BytesOrPanic()
+
+	definition := parseTestDefinition(t, chromeLikeDefinition)
+	for i := range definition.Extensions {
+		if definition.Extensions[i].Id == extensionEncryptedClientHello {
+			definition.Extensions[i].Data = base64.StdEncoding.EncodeToString(capturedData)
+		}
+	}
+	spec, err := definition.ToSpec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := clientHelloExtensionData(t, buildClientHello(t, &spec).HandshakeState.Hello.Raw, extensionEncryptedClientHello)
+	if len(data) != len(capturedData) || !bytes.Equal(data[:5], capturedData[:5]) {
+		t.Fatalf("expected the captured cipher suite and lengths, got %x", data)
+	}
+	if bytes.Equal(data[8:40], capturedData[8:40]) {
+		t.Fatal("expected a random encapsulated key")
+	}
+
+	definition.Extensions = []ClientHelloExtensionDefinition{{Id: extensionEncryptedClientHello, Data: "AQ=="}}
+	if _, err = definition.ToSpec(); err == nil {
+		t.Fatal("expected an inner ClientHello extension to be rejected")
+	}
+	definition.Extensions = []ClientHelloExtensionDefinition{{Id: 4660, Data: "not base64"}}
+	if _, err = definition.ToSpec(); err == nil {
+		t.Fatal("expected invalid base64 data to be rejected")
+	}
+}
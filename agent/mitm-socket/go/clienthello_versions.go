@@ -0,0 +1,174 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// Default browser version ranges. Can be overridden per browser with SessionArgs.ClientHelloVersionsPath or
+// SessionArgs.ClientHelloVersions so a new browser tls stack doesn't require a new release of this library.
+//
+//go:embed clienthellos/versions.json
+var defaultClientHelloVersionsJson []byte
+
+type ClientHelloBrowserVersions struct {
+	// fall back to the ranges of another browser (eg, edge extends chrome)
+	Extends string
+	Ranges  []ClientHelloVersionRange
+	// documents how the browser maps to ClientHellos
+	Note string
+}
+
+type ClientHelloVersionRange struct {
+	// inclusive. 0 means no lower bound
+	MinVersion int64
+	// inclusive. 0 means no upper bound
+	MaxVersion int64
+	// one of: a utls ClientHelloID name (eg, HelloChrome_133), a named ClientHello profile or an inline spec
+	UtlsId  string
+	Profile string
+	Spec    *ClientHelloDefinition
+	// documents why the range boundary exists
+	Note string
+}
+
+var utlsClientHelloIds = map[string]tls.ClientHelloID{
+	"HelloChrome_58":          tls.HelloChrome_58,
+	"HelloChrome_62":          tls.HelloChrome_62,
+	"HelloChrome_70":          tls.HelloChrome_70,
+	"HelloChrome_72":          tls.HelloChrome_72,
+	"HelloChrome_83":          tls.HelloChrome_83,
+	"HelloChrome_87":          tls.HelloChrome_87,
+	"HelloChrome_96":          tls.HelloChrome_96,
+	"HelloChrome_100":         tls.HelloChrome_100,
+	"HelloChrome_102":         tls.HelloChrome_102,
+	"HelloChrome_106_Shuffle": tls.HelloChrome_106_Shuffle,
+	"HelloChrome_120":         tls.HelloChrome_120,
+	"HelloChrome_120_PQ":      tls.HelloChrome_120_PQ,
+	"HelloChrome_131":         tls.HelloChrome_131,
+	"HelloChrome_133":         tls.HelloChrome_133,
+	"HelloFirefox_55":         tls.HelloFirefox_55,
+	"HelloFirefox_56":         tls.HelloFirefox_56,
+	"HelloFirefox_63":         tls.HelloFirefox_63,
+	"HelloFirefox_65":         tls.HelloFirefox_65,
+	"HelloFirefox_99":         tls.HelloFirefox_99,
+	"HelloFirefox_102":        tls.HelloFirefox_102,
+	"HelloFirefox_105":        tls.HelloFirefox_105,
+	"HelloFirefox_120":        tls.HelloFirefox_120,
+	"HelloIOS_11_1":           tls.HelloIOS_11_1,
+	"HelloIOS_12_1":           tls.HelloIOS_12_1,
+	"HelloIOS_13":             tls.HelloIOS_13,
+	"HelloIOS_14":             tls.HelloIOS_14,
+	"HelloEdge_85":            tls.HelloEdge_85,
+	"HelloEdge_106":           tls.HelloEdge_106,
+	"HelloSafari_16_0":        tls.HelloSafari_16_0,
+}
+
+var clientHelloVersions map[string]ClientHelloBrowserVersions
+
+// InitClientHelloVersions loads the version table once per session. Custom tables replace the defaults
+// for each browser they list.
+func InitClientHelloVersions(sessionArgs SessionArgs) error {
+	versions := make(map[string]ClientHelloBrowserVersions)
+	err := json.Unmarshal(defaultClientHelloVersionsJson, &versions)
+	if err != nil {
+		return err
+	}
+
+	if sessionArgs.ClientHelloVersionsPath != "" {
+		versionsJson, err := os.ReadFile(sessionArgs.ClientHelloVersionsPath)
+		if err != nil {
+			return err
+		}
+		fromFile := make(map[string]ClientHelloBrowserVersions)
+		err = json.Unmarshal(versionsJson, &fromFile)
+		if err != nil {
+			return fmt.Errorf("Invalid ClientHello versions file %s (%s)", sessionArgs.ClientHelloVersionsPath, err)
+		}
+		for browser, browserVersions := range fromFile {
+			versions[browser] = browserVersions
+		}
+	}
+
+	for browser, browserVersions := range sessionArgs.ClientHelloVersions {
+		versions[browser] = browserVersions
+	}
+
+	for browser, browserVersions := range versions {
+		if browserVersions.Extends != "" {
+			if _, ok := versions[browserVersions.Extends]; !ok {
+				return fmt.Errorf("ClientHello versions for %s extend unknown browser %s", browser, browserVersions.Extends)
+			}
+		}
+		for _, versionRange := range browserVersions.Ranges {
+			if versionRange.UtlsId != "" {
+				if _, ok := utlsClientHelloIds[versionRange.UtlsId]; !ok {
+					return fmt.Errorf("ClientHello versions for %s use unknown utls id %s", browser, versionRange.UtlsId)
+				}
+			} else if versionRange.Profile == "" && versionRange.Spec == nil {
+				return fmt.Errorf("ClientHello versions for %s have a range without a utlsId, profile or spec", browser)
+			}
+			// profiles and inline specs fail here instead of on the first connection that uses them
+			if _, _, err := versionRange.ToSpec(browser, sessionArgs.ClientHelloProfilesDir); err != nil {
+				return fmt.Errorf("ClientHello versions for %s have an invalid range %d-%d (%s)", browser, versionRange.MinVersion, versionRange.MaxVersion, err)
+			}
+		}
+	}
+
+	clientHelloVersions = versions
+	return nil
+}
+
+func (versionRange *ClientHelloVersionRange) Matches(version int64) bool {
+	if versionRange.MinVersion > 0 && version < versionRange.MinVersion {
+		return false
+	}
+	if versionRange.MaxVersion > 0 && version > versionRange.MaxVersion {
+		return false
+	}
+	return true
+}
+
+// FindClientHelloVersion returns the spec for a browser version and the name of the profile that was picked.
+// Profiles are loaded from profilesDir (SessionArgs.ClientHelloProfilesDir) before the built-in ones.
+func FindClientHelloVersion(browser string, version int64, profilesDir string) (tls.ClientHelloSpec, string, error) {
+	visited := make(map[string]bool)
+	for lookup := browser; lookup != "" && !visited[lookup]; {
+		visited[lookup] = true
+		browserVersions, ok := clientHelloVersions[lookup]
+		if !ok {
+			break
+		}
+		for _, versionRange := range browserVersions.Ranges {
+			if versionRange.Matches(version) {
+				return versionRange.ToSpec(browser, profilesDir)
+			}
+		}
+		lookup = browserVersions.Extends
+	}
+
+	return tls.ClientHelloSpec{}, "", fmt.Errorf("No ClientHello configured for %s %d", browser, version)
+}
+
+func (versionRange *ClientHelloVersionRange) ToSpec(browser string, profilesDir string) (tls.ClientHelloSpec, string, error) {
+	if versionRange.UtlsId != "" {
+		spec, err := tls.UTLSIdToSpec(utlsClientHelloIds[versionRange.UtlsId])
+		return spec, versionRange.UtlsId, err
+	}
+
+	if versionRange.Profile != "" {
+		profile, err := LoadClientHelloProfile(versionRange.Profile, profilesDir)
+		if err != nil {
+			return tls.ClientHelloSpec{}, "", err
+		}
+		spec, err := profile.ToSpec()
+		return spec, versionRange.Profile, err
+	}
+
+	spec, err := versionRange.Spec.ToSpec()
+	return spec, fmt.Sprintf("%s-%d-%d", browser, versionRange.MinVersion, versionRange.MaxVersion), err
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestClientHelloVersionsUseProfilesDir(t *testing.T) {
+	profileJson, err := clientHelloProfiles.ReadFile("clienthellos/safari26.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	profilesDir := t.TempDir()
+	if err = os.WriteFile(filepath.Join(profilesDir, "custom-safari.json"), profileJson, 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { InitClientHelloVersions(SessionArgs{}) })
+
+	versions := map[string]ClientHelloBrowserVersions{
+		"custom": {Ranges: []ClientHelloVersionRange{{Profile: "custom-safari"}}},
+	}
+	err = InitClientHelloVersions(SessionArgs{ClientHelloVersions: versions})
+	if err == nil || !strings.Contains(err.Error(), "custom-safari") {
+		t.Fatalf("expected a profile missing from the built-in profiles to fail at startup, got %v", err)
+	}
+
+	sessionArgs := SessionArgs{ClientHelloVersions: versions, ClientHelloProfilesDir: profilesDir, ClientHelloId: "custom-26"}
+	if err = InitClientHelloVersions(sessionArgs); err != nil {
+		t.Fatal(err)
+	}
+	spec, profile, err := getClientHelloSpec(sessionArgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile != "custom-safari" || len(spec.CipherSuites) == 0 {
+		t.Fatalf("expected the profile from the profiles dir, got %s", profile)
+	}
+}
+
+func TestClientHelloVersionsRejectInvalidSpecs(t *testing.T) {
+	t.Cleanup(func() { InitClientHelloVersions(SessionArgs{}) })
+	spec := &ClientHelloDefinition{
+		TlsVersMin:   0x0303,
+		TlsVersMax:   0x0304,
+		CipherSuites: []uint16{0x1301},
+		Extensions:   []ClientHelloExtensionDefinition{{Id: 0xfe02, Data: "not base64!"}},
+	}
+	err := InitClientHelloVersions(SessionArgs{ClientHelloVersions: map[string]ClientHelloBrowserVersions{
+		"custom": {Ranges: []ClientHelloVersionRange{{MinVersion: 1, MaxVersion: 10, Spec: spec}}},
+	}})
+	if err == nil || !strings.Contains(err.Error(), "1-10") {
+		t.Fatalf("expected an invalid inline spec to fail at startup, got %v", err)
+	}
+}
+
+func TestClientHelloIdVersions(t *testing.T) {
+	if err := InitClientHelloVersions(SessionArgs{}); err != nil {
+		t.Fatal(err)
+	}
+	for clientHelloId, expected := range map[string]string{
+		"chrome-115":     "HelloChrome_106_Shuffle",
+		"chrome-133.0.1": "HelloChrome_133",
+		// edge uses the chrome spec of the same chromium version
+		"edge-85":  "HelloChrome_83",
+		"edge-95":  "HelloChrome_96",
+		"edge-106": "HelloChrome_100",
+		"edge-131": "HelloChrome_131",
+		// legacy id
+		"Chrome79": "HelloChrome_106_Shuffle",
+		"":         "HelloChrome_106_Shuffle",
+	} {
+		_, profile, err := getClientHelloSpec(SessionArgs{ClientHelloId: clientHelloId})
+		if err != nil || profile != expected {
+			t.Errorf("%s: expected %s, got %s %v", clientHelloId, expected, profile, err)
+		}
+	}
+	for _, clientHelloId := range []string{"chrome-latest", "chrome-", "chrome--5", "firefox-x120", "opera-100", "Chrome80", "Safari14"} {
+		if _, _, err := getClientHelloSpec(SessionArgs{ClientHelloId: clientHelloId}); err == nil {
+			t.Errorf("expected %s to be rejected", clientHelloId)
+		}
+	}
+}
@@ -2,15 +2,19 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"syscall"
 )
 
-func ConfigureSocket(ttl int, windowSize int) func(network string, addr string, c syscall.RawConn) error {
+// ConfigureSocket sets socket options before connecting. Failing to bind to a device or set a mark fails the
+// connection, so traffic never leaves through the wrong interface or routing table.
+func ConfigureSocket(ttl int, windowSize int, bindToDevice string, socketMark int) func(network string, addr string, c syscall.RawConn) error {
 	return func(network string, addr string, c syscall.RawConn) error {
-		if ttl == 0 && windowSize == 0 {
+		if ttl == 0 && windowSize == 0 && bindToDevice == "" && socketMark == 0 {
 			return nil
 		}
+		var bindErr error
 		configErr := c.Control(func(fd uintptr) {
 			if ttl > 0 {
 				err := ConfigureTcpTtl(fd, ttl)
@@ -24,10 +28,23 @@ func ConfigureSocket(ttl int, windowSize int) func(network string, addr string,
 					log.Printf("Error setting SO_RCVBUF. %#v", err)
 				}
 			}
+			if bindToDevice != "" {
+				err := ConfigureBindToDevice(fd, bindToDevice)
+				if err != nil {
+					bindErr = fmt.Errorf("SO_BINDTODEVICE %s failed (%s)", bindToDevice, err)
+					return
+				}
+			}
+			if socketMark != 0 {
+				err := ConfigureSocketMark(fd, socketMark)
+				if err != nil {
+					bindErr = fmt.Errorf("SO_MARK %d failed (%s)", socketMark, err)
+				}
+			}
 		})
 		if configErr != nil {
 			return configErr
 		}
-		return nil
+		return bindErr
 	}
 }
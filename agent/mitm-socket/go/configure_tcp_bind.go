@@ -0,0 +1,14 @@
+//go:build linux
+// +build linux
+
+package main
+
+import "syscall"
+
+func ConfigureBindToDevice(fd uintptr, device string) error {
+	return syscall.BindToDevice(int(fd), device)
+}
+
+func ConfigureSocketMark(fd uintptr, mark int) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+}
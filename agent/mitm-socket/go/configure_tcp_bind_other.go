@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+func ConfigureBindToDevice(fd uintptr, device string) error {
+	return errors.New("BindToDevice is only supported on linux")
+}
+
+func ConfigureSocketMark(fd uintptr, mark int) error {
+	return errors.New("SocketMark is only supported on linux")
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -18,6 +19,14 @@ import (
 const CertsMode = "certs"
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "certs" {
+		err := RunCertsCommand(os.Args[2:])
+		if err != nil {
+			log.Fatalf("Certs Command Error: %+v\n", err)
+		}
+		return
+	}
+
 	var sessionArgs = SessionArgs{}
 	var certConfig *CertConfig
 	json.Unmarshal([]byte(os.Args[1]), &sessionArgs)
@@ -35,14 +44,112 @@ func main() {
 	defer conn.Close()
 
 	if sessionArgs.Mode == CertsMode {
-		certConfig, err = NewCertConfig(nil, nil)
+		storageDir := sessionArgs.CertStorageDir
+		if storageDir == "" {
+			storageDir = sessionArgs.StorageDir
+		}
+		if storageDir != "" {
+			err = os.MkdirAll(storageDir, 0700)
+			if err != nil {
+				log.Fatalf("Creating Cert Storage Dir Error: %+v\n", err)
+			}
+		}
+
+		ca, caPrivateKey, err := LoadAuthority(sessionArgs, storageDir)
+		if err != nil {
+			log.Fatalf("Loading CA Error: %+v\n", err)
+		}
+
+		if ca != nil && sessionArgs.CaPkcs11 == nil && !sessionArgs.CaNameConstraints.isEmpty() {
+			log.Printf("CaNameConstraints only apply to a generated CA. Using the constraints of %s", ca.Subject)
+		}
+
+		certConfig, err = NewCertConfig(storageDir, ca, caPrivateKey, sessionArgs.CaKeyType, sessionArgs.LeafKeyType, sessionArgs.CaNameConstraints)
 		if err != nil {
 			log.Fatalf("Initializing Cert Config Error: %+v\n", err)
 		}
 
+		if sessionArgs.RevocationServerAddress != "" {
+			revocationServer, err = StartRevocationServer(certConfig, sessionArgs.RevocationServerAddress)
+			if err != nil {
+				log.Fatalf("Starting Revocation Server Error: %+v\n", err)
+			}
+		}
+
 		SendToIpc(0, "init", map[string]interface{}{
-			"privateKey": certConfig.privateKeyPEM,
+			"privateKey":    certConfig.privateKeyPEM,
+			"revocationUrl": certConfig.revocationUrl,
 		})
+
+		caRotationDays := sessionArgs.CaRotationDays
+		if sessionArgs.DisableCaRotation {
+			caRotationDays = -1
+		}
+		err = certConfig.CheckAuthorityExpiry(sessionArgs.CaExpiryWarningDays, caRotationDays)
+		if err != nil {
+			SendErrorToIpc(0, "caRotation", err)
+		}
+		certConfig.WatchAuthorityExpiry(sessionArgs.CaExpiryWarningDays, caRotationDays)
+
+		if !sessionArgs.DisableCertCache {
+			certCache = NewCertCache(sessionArgs.CertCacheSize)
+			if sessionArgs.CertCachePath != "" {
+				err = certCache.Load(sessionArgs.CertCachePath, certConfig)
+				if err != nil {
+					log.Printf("Error restoring certificates from %s. %#v", sessionArgs.CertCachePath, err)
+				}
+				defer func() {
+					err := certCache.Save(sessionArgs.CertCachePath)
+					if err != nil {
+						log.Printf("Error saving certificates to %s. %#v", sessionArgs.CertCachePath, err)
+					}
+				}()
+			}
+			go certConfig.WarmupCertCache(sessionArgs.CertCacheWarmupHosts)
+		}
+	} else {
+		err = InitClientHelloVersions(sessionArgs)
+		if err != nil {
+			log.Fatalf("Initializing ClientHello Versions Error: %+v\n", err)
+		}
+
+		err = InitTrustStore(sessionArgs)
+		if err != nil {
+			log.Fatalf("Initializing Trust Store Error: %+v\n", err)
+		}
+
+		err = InitClientCertificates(sessionArgs)
+		if err != nil {
+			log.Fatalf("Initializing Client Certificates Error: %+v\n", err)
+		}
+
+		err = ValidateSocketBinding(sessionArgs)
+		if err != nil {
+			SendErrorToIpc(0, "socketBinding", err)
+			log.Fatalf("Binding Outgoing Connections Error: %+v\n", err)
+		}
+
+		// after the trust store, which DoH and DoT servers are verified with
+		err = InitDnsResolver(sessionArgs)
+		if err != nil {
+			log.Fatalf("Initializing Dns Resolver Error: %+v\n", err)
+		}
+
+		if !sessionArgs.DisableTlsSessionCache {
+			tlsSessionCache = NewTlsSessionCache(sessionArgs.TlsSessionCacheSize)
+			if sessionArgs.TlsSessionCachePath != "" {
+				err = tlsSessionCache.Load(sessionArgs.TlsSessionCachePath)
+				if err != nil {
+					log.Printf("Error restoring tls sessions from %s. %#v", sessionArgs.TlsSessionCachePath, err)
+				}
+				defer func() {
+					err := tlsSessionCache.Save(sessionArgs.TlsSessionCachePath)
+					if err != nil {
+						log.Printf("Error saving tls sessions to %s. %#v", sessionArgs.TlsSessionCachePath, err)
+					}
+				}()
+			}
+		}
 	}
 
 	var msg []byte
@@ -63,15 +170,47 @@ func main() {
 		json.Unmarshal(msg, &connectArgs)
 
 		if sessionArgs.Mode == CertsMode {
-			go generateCert(certConfig, connectArgs.Id, connectArgs.Host)
+			go generateCert(certConfig, connectArgs)
 		} else {
 			go handleSocket(connectArgs, sessionArgs, signals)
 		}
 	}
 }
 
-func generateCert(config *CertConfig, id int, hostname string) {
-	cert, expireDate, err := config.CreateCert(hostname)
+func generateCert(config *CertConfig, connectArgs ConnectArgs) {
+	id := connectArgs.Id
+	if connectArgs.RevokeCert != "" {
+		if revocationServer == nil {
+			SendErrorToIpc(id, "revoke", errors.New("Revocation requires SessionArgs.RevocationServerAddress"))
+			return
+		}
+		serialNumber, err := revocationServer.Revoke(connectArgs.RevokeCert, connectArgs.RevocationReason)
+		if err != nil {
+			SendErrorToIpc(id, "revoke", err)
+			return
+		}
+		SendToIpc(id, "revoked", map[string]interface{}{
+			"serialNumber": serialNumber.String(),
+		})
+		return
+	}
+
+	if connectArgs.UpstreamCert != "" {
+		cert, err := config.CachedMirrorCert(connectArgs.Host, connectArgs.UpstreamCert)
+		if err != nil {
+			SendErrorToIpc(id, "mirrorCert", err)
+			return
+		}
+
+		SendToIpc(id, "certs", map[string]interface{}{
+			"cert":       string(cert.Cert),
+			"privateKey": cert.PrivateKey,
+			"expireDate": cert.ExpireDate,
+		})
+		return
+	}
+
+	cert, err := config.CachedCert(connectArgs.Host)
 
 	if err != nil {
 		SendErrorToIpc(id, "ipcConnect", err)
@@ -79,8 +218,8 @@ func generateCert(config *CertConfig, id int, hostname string) {
 	}
 
 	SendToIpc(id, "certs", map[string]interface{}{
-		"cert":       string(cert),
-		"expireDate": expireDate,
+		"cert":       string(cert.Cert),
+		"expireDate": cert.ExpireDate,
 	})
 }
 
@@ -89,6 +228,12 @@ func handleSocket(connectArgs ConnectArgs, sessionArgs SessionArgs, signals *Sig
 	var protocol string
 	var applicationSettings []byte
 	var alpsFrames AlpsFrames
+	var rawClientHello []byte
+	var fingerprint *ClientHelloFingerprint
+	var emulatedTls *EmulatedTls
+	var resumed bool
+	var echResult *EchResult
+	var tlsState utls.ConnectionState
 
 	id := connectArgs.Id
 	if sessionArgs.Debug {
@@ -111,7 +256,7 @@ func handleSocket(connectArgs ConnectArgs, sessionArgs SessionArgs, signals *Sig
 	defer domainSocketPiper.Close()
 
 	addr := fmt.Sprintf("%s:%s", connectArgs.Host, connectArgs.Port)
-	dialConn, connectErr := Dial(addr, connectArgs, sessionArgs)
+	dialConn, dialInfo, connectErr := Dial(addr, connectArgs, sessionArgs)
 
 	if connectErr != nil {
 		SendErrorToIpc(id, "dial", connectErr)
@@ -120,14 +265,53 @@ func handleSocket(connectArgs ConnectArgs, sessionArgs SessionArgs, signals *Sig
 	defer dialConn.Close()
 
 	if connectArgs.IsSsl {
+		getEchConfigList := func() []byte {
+			echConfigList, err := GetEchConfigList(connectArgs)
+			if err != nil && sessionArgs.Debug {
+				// browsers fall back to GREASE ECH when the HTTPS record can't be resolved
+				fmt.Printf("[id=%d] Unable to get ECHConfigList %+v\n", id, err)
+			}
+			return echConfigList
+		}
 		var err error
-		uTlsConn, err = EmulateTls(dialConn, addr, sessionArgs, connectArgs)
+		uTlsConn, emulatedTls, err = EmulateTls(dialConn, addr, sessionArgs, connectArgs, getEchConfigList)
+
+		// like chrome, retry once on a new connection with the server's retry configs (or without ECH if it sent none)
+		var echRejection *utls.ECHRejectionError
+		if errors.As(err, &echRejection) {
+			echResult = &EchResult{Status: echStatusRejected, RetryConfigs: echRejection.RetryConfigList}
+			dialConn.Close()
+			dialConn, dialInfo, connectErr = Dial(addr, connectArgs, sessionArgs)
+			if connectErr != nil {
+				SendErrorToIpc(id, "dial", connectErr)
+				return
+			}
+			defer dialConn.Close()
+			uTlsConn, emulatedTls, err = EmulateTls(dialConn, addr, sessionArgs, connectArgs, func() []byte { return echResult.RetryConfigs })
+		}
+		var pinMismatch *PinMismatchError
+		if errors.As(err, &echRejection) {
+			SendErrorToIpc(id, "ech", err)
+			return
+		}
+		if errors.As(err, &pinMismatch) {
+			SendErrorToIpc(id, "certificatePin", err)
+			return
+		}
 		if err != nil {
 			SendErrorToIpc(id, "emulateTls", err)
 			return
 		}
-		protocol = uTlsConn.ConnectionState().NegotiatedProtocol
-		applicationSettings = uTlsConn.ConnectionState().PeerApplicationSettings
+		rawClientHello = uTlsConn.HandshakeState.Hello.Raw
+		fingerprint, err = FingerprintClientHello(rawClientHello)
+		if err != nil && sessionArgs.Debug {
+			fmt.Printf("[id=%d] Unable to fingerprint ClientHello %+v\n", id, err)
+		}
+		tlsState = uTlsConn.ConnectionState()
+		resumed = tlsState.DidResume
+		echResult = getEchResult(echResult, tlsState, rawClientHello)
+		protocol = tlsState.NegotiatedProtocol
+		applicationSettings = tlsState.PeerApplicationSettings
 		if applicationSettings != nil {
 			buf := new(bytes.Buffer)
 			alps := bytes.NewBuffer(applicationSettings)
@@ -161,13 +345,56 @@ func handleSocket(connectArgs ConnectArgs, sessionArgs SessionArgs, signals *Sig
 		}
 	}
 
-	SendToIpc(id, "connected", map[string]interface{}{
+	connectedMessage := map[string]interface{}{
 		"alpn":                   protocol,
 		"rawApplicationSettings": applicationSettings,
 		"alps":                   alpsFrames,
 		"remoteAddress":          dialConn.RemoteAddr().String(),
 		"localAddress":           dialConn.LocalAddr().String(),
-	})
+		"resumed":                resumed,
+	}
+	if dialInfo != nil {
+		connectedMessage["ipFamily"] = dialInfo.IpFamily
+		connectedMessage["losingDialAttempts"] = dialInfo.LosingAttempts
+		if dialInfo.DnsResolvedIp != "" {
+			connectedMessage["dnsResolvedIp"] = dialInfo.DnsResolvedIp
+		}
+	}
+	if uTlsConn != nil {
+		connectedMessage["tlsVersion"] = utls.VersionName(tlsState.Version)
+		connectedMessage["cipherSuite"] = utls.CipherSuiteName(tlsState.CipherSuite)
+		connectedMessage["peerCertificates"] = peerCertificatesPem(tlsState)
+		connectedMessage["ocspResponse"] = tlsState.OCSPResponse
+		connectedMessage["signedCertificateTimestamps"] = tlsState.SignedCertificateTimestamps
+		if applicationSettings != nil {
+			connectedMessage["alpsCodepoint"] = offeredAlpsCodepoint(rawClientHello)
+		}
+	}
+	if emulatedTls != nil {
+		connectedMessage["clientHelloProfile"] = emulatedTls.ClientHelloProfile
+		if emulatedTls.KeyExchangeGroup != 0 {
+			connectedMessage["keyExchangeGroup"] = emulatedTls.KeyExchangeGroup.String()
+		}
+		if emulatedTls.ClientCertificate != nil {
+			connectedMessage["clientCertificate"] = emulatedTls.ClientCertificate
+		}
+	}
+	if rawClientHello != nil {
+		connectedMessage["rawClientHello"] = rawClientHello
+	}
+	if echResult != nil {
+		connectedMessage["ech"] = echResult.Status
+		if echResult.RetryConfigs != nil {
+			connectedMessage["echRetryConfigs"] = echResult.RetryConfigs
+		}
+	}
+	if fingerprint != nil {
+		connectedMessage["ja3"] = fingerprint.Ja3
+		connectedMessage["ja3Hash"] = fingerprint.Ja3Hash
+		connectedMessage["ja4"] = fingerprint.Ja4
+		connectedMessage["ja4r"] = fingerprint.Ja4r
+	}
+	SendToIpc(id, "connected", connectedMessage)
 
 	if uTlsConn != nil {
 		domainSocketPiper.Pipe(uTlsConn)
@@ -195,16 +422,94 @@ type ConnectArgs struct {
 	IsWebsocket         bool
 	KeylogPath          string
 	ApplicationSettings map[string]string
+	// certs mode: PEM leaf certificate of the upstream server to mirror
+	UpstreamCert string
+	// certs mode: PEM certificate to revoke (with an RFC 5280 reason code) instead of generating one
+	RevokeCert       string
+	RevocationReason int
+	// presented if the server requests a client certificate. Overrides SessionArgs.ClientCertificates.
+	ClientCertificate *ClientCertificateDefinition
+	// proxy chain. Each proxy is reached through the previous one. Errors name the failing hop (0 is the first).
+	ProxyUrls []string
+	// overrides SessionArgs.LocalAddress, BindToDevice and SocketMark
+	LocalAddress string
+	BindToDevice string
+	SocketMark   int
+	// base64 ECHConfigList. Looked up in the DNS HTTPS record when empty and SessionArgs.DnsResolver or EchDnsServer is set.
+	EchConfigList string
 }
 
 type SessionArgs struct {
 	IpcSocketPath      string
 	RejectUnauthorized bool
-	UserAgent           string
+	UserAgent          string
 	ClientHelloId      string
-	TcpTtl             int
-	TcpWindowSize      int
-	Debug              bool
-	DebugData          bool
-	Mode               string
+	ClientHelloSpec    *ClientHelloDefinition
+	// hex or base64 ClientHello captured from a real browser
+	ClientHelloRaw         string
+	ClientHelloProfile     string
+	ClientHelloProfilesDir string
+	// override the browser version -> ClientHello table
+	ClientHelloVersionsPath string
+	ClientHelloVersions     map[string]ClientHelloBrowserVersions
+	// tls sessions are shared by all connections of a session. Set a path to persist them across restarts
+	DisableTlsSessionCache bool
+	TlsSessionCacheSize    int
+	TlsSessionCachePath    string
+	// certs mode: directory with the generated CA and keys (defaults to StorageDir, then the working directory)
+	CertStorageDir string
+	StorageDir     string
+	// certs mode: rsa-2048 (default), rsa-3072, rsa-4096, ecdsa-p256, ecdsa-p384 or ed25519
+	CaKeyType   string
+	LeafKeyType string
+	// certs mode: an existing CA to sign with. PEM or DER cert + key, or a PKCS#12 bundle.
+	CaCertPath       string
+	CaKeyPath        string
+	CaPkcs12Path     string
+	CaPkcs12Password string
+	// certs mode: sign with a CA key on a PKCS#11 token (HSM). CaCertPath optionally provides the CA certificate.
+	CaPkcs11 *Pkcs11Config
+	// certs mode: limit the names a generated CA can issue for, eg, { PermittedDnsDomains: ["example.com"] }
+	CaNameConstraints *CaNameConstraints
+	// certs mode: serve an OCSP responder and CRL (eg, 127.0.0.1:0). Their urls are embedded in leaf certificates.
+	RevocationServerAddress string
+	// days before expiry to warn (caExpiring) and to rotate a generated CA (caRotated). Default 60 and 30.
+	CaExpiryWarningDays int
+	CaRotationDays      int
+	DisableCaRotation   bool
+	// certs mode: generated leaf certificates are cached in memory. Set a path to persist them across restarts
+	DisableCertCache     bool
+	CertCacheSize        int
+	CertCachePath        string
+	CertCacheWarmupHosts []string
+	// extra root CAs (PEM) trusted when RejectUnauthorized is set. ReplaceSystemRootCas ignores the system pool.
+	RootCaPem            string
+	RootCaPath           string
+	ReplaceSystemRootCas bool
+	// base64 sha256 SubjectPublicKeyInfo hashes by host (or *.domain). One must be in the verified chain.
+	SpkiPins map[string][]string
+	// client certificates by host (or *.domain)
+	ClientCertificates map[string]ClientCertificateDefinition
+	// ipv4 or ipv6 only. Both families are raced (happy eyeballs) by default, starting with PreferredIpFamily (ipv6).
+	IpFamily                    string
+	PreferredIpFamily           string
+	HappyEyeballsAttemptDelayMs int
+	// system (default), udp, tcp, DNS-over-HTTPS or DNS-over-TLS resolution of direct connection hostnames
+	DnsResolver *DnsResolverConfig
+	// answers (and ECHConfigLists from HTTPS records) are cached for their ttl and shared by all connections of a session
+	DisableDnsCache bool
+	DnsCacheSize    int
+	// Chrome --host-resolver-rules for direct connections, eg, "MAP *.example.com 127.0.0.1:8443, EXCLUDE api.example.com"
+	HostResolverRules string
+	// local ip address, network interface (linux SO_BINDTODEVICE) and fwmark (linux SO_MARK) of outgoing connections
+	LocalAddress string
+	BindToDevice string
+	SocketMark   int
+	// dns server (host:port) used to fetch ECHConfigLists from HTTPS records when DnsResolver is the system resolver
+	EchDnsServer  string
+	TcpTtl        int
+	TcpWindowSize int
+	Debug         bool
+	DebugData     bool
+	Mode          string
 }
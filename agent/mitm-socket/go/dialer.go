@@ -1,36 +1,59 @@
 package main
 
 import (
+	"errors"
 	"net"
 	"net/url"
 	"time"
 )
 
-func Dial(addr string, connectArgs ConnectArgs, sessionArgs SessionArgs) (net.Conn, error) {
+func Dial(addr string, connectArgs ConnectArgs, sessionArgs SessionArgs) (net.Conn, *DialInfo, error) {
 	var dialTimeout = time.Duration(15) * time.Second
 
+	binding, err := getSocketBinding(connectArgs, sessionArgs)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	/// Dial the server
 	dialer := net.Dialer{
-		Control: ConfigureSocket(sessionArgs.TcpTtl, sessionArgs.TcpWindowSize),
+		Control: ConfigureSocket(sessionArgs.TcpTtl, sessionArgs.TcpWindowSize, binding.bindToDevice, binding.socketMark),
 		Timeout: dialTimeout,
 	}
+	if binding.localAddr != nil {
+		dialer.LocalAddr = binding.localAddr
+	}
 
+	proxyUrls := connectArgs.ProxyUrls
 	if connectArgs.ProxyUrl != "" {
-		proxyUrl, err := url.Parse(connectArgs.ProxyUrl)
+		if len(proxyUrls) > 0 {
+			return nil, nil, errors.New("Set ProxyUrl or ProxyUrls, not both")
+		}
+		proxyUrls = []string{connectArgs.ProxyUrl}
+	}
+
+	if len(proxyUrls) == 1 {
+		proxyUrl, err := url.Parse(proxyUrls[0])
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
+		var proxyConn net.Conn
 		if proxyUrl.Scheme == "socks5" || proxyUrl.Scheme == "socks5h" {
-			return DialAddrViaSock5Proxy(dialer, addr, proxyUrl)
+			proxyConn, err = DialAddrViaSock5Proxy(&dialer, addr, proxyUrl)
+		} else {
+			proxyConn, err = DialAddrViaHttpProxy(&dialer, addr, proxyUrl, !sessionArgs.RejectUnauthorized, sessionArgs.UserAgent)
 		}
-
-		return DialAddrViaHttpProxy(dialer, addr, proxyUrl, !sessionArgs.RejectUnauthorized, sessionArgs.UserAgent)
+		return proxyConn, nil, err
+	}
+	if len(proxyUrls) > 1 {
+		proxyConn, err := DialAddrViaProxyChain(&dialer, addr, proxyUrls, !sessionArgs.RejectUnauthorized, sessionArgs.UserAgent)
+		return proxyConn, nil, err
 	}
 
-	dialConn, err := dialer.Dial("tcp", addr)
+	dialConn, dialInfo, err := DialHappyEyeballs(dialer, addr, sessionArgs)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	tcpConn, ok := dialConn.(*net.TCPConn)
@@ -42,5 +65,5 @@ func Dial(addr string, connectArgs ConnectArgs, sessionArgs SessionArgs) (net.Co
 		tcpConn.SetLinger(0)
 	}
 
-	return dialConn, nil
+	return dialConn, dialInfo, nil
 }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+
+	"golang.org/x/net/proxy"
+)
+
+// ProxyHopError is returned when a proxy in a chain fails to connect to the next hop (or the destination)
+type ProxyHopError struct {
+	// position in ConnectArgs.ProxyUrls. Hop 0 is the proxy connected to directly.
+	Index int
+	// without credentials
+	ProxyUrl string
+	Addr     string
+	Err      error
+}
+
+func (e *ProxyHopError) Error() string {
+	return fmt.Sprintf("Proxy hop %d (%s) failed to connect to %s: %s", e.Index, e.ProxyUrl, e.Addr, e.Err)
+}
+
+func (e *ProxyHopError) Unwrap() error {
+	return e.Err
+}
+
+// proxyHopDialer connects through one proxy of a chain. The proxy is reached with the forward dialer: the network
+// for the first hop, otherwise a tunnel through the previous hop.
+type proxyHopDialer struct {
+	forward       proxy.Dialer
+	index         int
+	proxyUrl      *url.URL
+	allowInsecure bool
+	userAgent     string
+}
+
+func (d *proxyHopDialer) Dial(network string, addr string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if d.proxyUrl.Scheme == "socks5" || d.proxyUrl.Scheme == "socks5h" {
+		conn, err = DialAddrViaSock5Proxy(d.forward, addr, d.proxyUrl)
+	} else {
+		conn, err = DialAddrViaHttpProxy(d.forward, addr, d.proxyUrl, d.allowInsecure, d.userAgent)
+	}
+	if err != nil {
+		// an earlier hop couldn't open the tunnel to this proxy
+		var hopErr *ProxyHopError
+		if errors.As(err, &hopErr) {
+			return nil, hopErr
+		}
+		return nil, &ProxyHopError{Index: d.index, ProxyUrl: d.proxyUrl.Redacted(), Addr: addr, Err: err}
+	}
+	return conn, nil
+}
+
+// DialAddrViaProxyChain connects to addr through each proxy in order (eg, socks5 -> http -> https). Every hop tunnels
+// through the previous one, so only the first proxy is connected to directly.
+func DialAddrViaProxyChain(dialer proxy.Dialer, addr string, proxyUrls []string, allowInsecure bool, userAgent string) (net.Conn, error) {
+	forward := dialer
+	for i, rawUrl := range proxyUrls {
+		proxyUrl, err := url.Parse(rawUrl)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid proxy url at hop %d (%s)", i, err)
+		}
+		forward = &proxyHopDialer{
+			forward:       forward,
+			index:         i,
+			proxyUrl:      proxyUrl,
+			allowInsecure: allowInsecure,
+			userAgent:     userAgent,
+		}
+	}
+	return forward.Dial("tcp", addr)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func pipeTest(a net.Conn, b net.Conn) {
+	go io.Copy(a, b)
+	io.Copy(b, a)
+}
+
+// startTestSocks5Proxy accepts unauthenticated CONNECT requests for ipv4 addresses (RFC 1928)
+func startTestSocks5Proxy(t *testing.T) string {
+	return listenTest(t, func(conn net.Conn) {
+		var greeting [2]byte
+		if _, err := io.ReadFull(conn, greeting[:]); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(conn, make([]byte, greeting[1])); err != nil {
+			return
+		}
+		conn.Write([]byte{5, 0})
+
+		var request [10]byte
+		if _, err := io.ReadFull(conn, request[:]); err != nil || request[3] != 1 {
+			return
+		}
+		addr := net.JoinHostPort(net.IP(request[4:8]).String(), strconv.Itoa(int(binary.BigEndian.Uint16(request[8:]))))
+		upstream, err := net.Dial("tcp", addr)
+		if err != nil {
+			// connection refused
+			conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer upstream.Close()
+		conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		pipeTest(conn, upstream)
+	})
+}
+
+// startTestHttpProxy tunnels CONNECT requests, except to the refused address
+func startTestHttpProxy(t *testing.T, refusedAddr string) string {
+	return listenTest(t, func(conn net.Conn) {
+		request, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil || request.Method != http.MethodConnect {
+			return
+		}
+		if request.Host == refusedAddr {
+			conn.Write([]byte("HTTP/1.1 403 Forbidden\r\nContent-Length: 7\r\n\r\nblocked"))
+			return
+		}
+		upstream, err := net.Dial("tcp", request.Host)
+		if err != nil {
+			conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n"))
+			return
+		}
+		defer upstream.Close()
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		pipeTest(conn, upstream)
+	})
+}
+
+func TestProxyChainSocks5ToHttp(t *testing.T) {
+	echoAddr := listenTest(t, func(conn net.Conn) { io.Copy(conn, conn) })
+	refusedAddr := listenTest(t, func(conn net.Conn) {})
+	socksAddr := startTestSocks5Proxy(t)
+	httpAddr := startTestHttpProxy(t, refusedAddr)
+	proxyUrls := []string{"socks5://" + socksAddr, "http://user:secret@" + httpAddr}
+	dialer := net.Dialer{Timeout: 5 * time.Second}
+
+	conn, err := DialAddrViaProxyChain(&dialer, echoAddr, proxyUrls, false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 5)
+	if _, err = io.ReadFull(conn, reply); err != nil || string(reply) != "hello" {
+		t.Fatalf("expected the echo through both proxies, got %q %v", reply, err)
+	}
+
+	// the http proxy (hop 1) refuses the destination
+	_, err = DialAddrViaProxyChain(&dialer, refusedAddr, proxyUrls, false, "")
+	var hopErr *ProxyHopError
+	if !errors.As(err, &hopErr) || hopErr.Index != 1 || hopErr.Addr != refusedAddr {
+		t.Fatalf("expected hop 1 to fail, got %v", err)
+	}
+	if hopErr.ProxyUrl != "http://user:xxxxx@"+httpAddr {
+		t.Fatalf("expected the redacted proxy url, got %s", hopErr.ProxyUrl)
+	}
+
+	// the socks proxy (hop 0) can't reach the http proxy
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := closed.Addr().String()
+	closed.Close()
+	_, err = DialAddrViaProxyChain(&dialer, echoAddr, []string{"socks5://" + socksAddr, "http://" + closedAddr}, false, "")
+	if !errors.As(err, &hopErr) || hopErr.Index != 0 || hopErr.Addr != closedAddr {
+		t.Fatalf("expected hop 0 to fail, got %v", err)
+	}
+}
+
+func TestProxyChainFirstHopUsesDialer(t *testing.T) {
+	echoAddr := listenTest(t, func(conn net.Conn) { io.Copy(conn, conn) })
+	socksAddr := startTestSocks5Proxy(t)
+	httpAddr := startTestHttpProxy(t, "")
+
+	var controlled []string
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: func(network string, address string, conn syscall.RawConn) error {
+			controlled = append(controlled, address)
+			return nil
+		},
+	}
+	conn, err := DialAddrViaProxyChain(dialer, echoAddr, []string{"socks5://" + socksAddr, "http://" + httpAddr}, false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	// later hops are tunneled through the first proxy
+	if len(controlled) != 1 || controlled[0] != socksAddr {
+		t.Fatalf("expected only the first hop to be dialed with the session dialer, got %v", controlled)
+	}
+}
+
+func TestDialProxyChainFromSessionLocalAddress(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("binding to 127.0.0.2 needs the linux loopback /8")
+	}
+	echoAddr := listenTest(t, func(conn net.Conn) { io.Copy(conn, conn) })
+	httpAddr := startTestHttpProxy(t, "")
+	firstHopSources := make(chan string, 1)
+	firstProxyAddr := startTestHttpProxy(t, "")
+	// records where connections to the first proxy come from, then forwards them to it
+	firstHopAddr := listenTest(t, func(conn net.Conn) {
+		host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		firstHopSources <- host
+		upstream, err := net.Dial("tcp", firstProxyAddr)
+		if err != nil {
+			return
+		}
+		defer upstream.Close()
+		pipeTest(conn, upstream)
+	})
+
+	connectArgs := ConnectArgs{ProxyUrls: []string{"http://" + firstHopAddr, "http://" + httpAddr}}
+	conn, _, err := Dial(echoAddr, connectArgs, SessionArgs{LocalAddress: "127.0.0.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if source := <-firstHopSources; source != "127.0.0.2" {
+		t.Fatalf("expected the first hop to be dialed from the session local address, got %s", source)
+	}
+}
@@ -13,9 +13,15 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
 )
 
-func DialAddrViaHttpProxy(dialer net.Dialer, addr string, proxyUrl *url.URL, allowInsecure bool, userAgent string) (net.Conn, error) {
+// a proxy that accepts the connection but never answers the CONNECT (or SOCKS) handshake fails instead of hanging
+const proxyHandshakeTimeout = 15 * time.Second
+
+func DialAddrViaHttpProxy(dialer proxy.Dialer, addr string, proxyUrl *url.URL, allowInsecure bool, userAgent string) (net.Conn, error) {
 	isSecure, proxyHost, err := getCleanHost(proxyUrl)
 
 	fmt.Printf("Dialing proxy connect %s to %s\n", proxyHost, addr)
@@ -43,9 +49,9 @@ func DialAddrViaHttpProxy(dialer net.Dialer, addr string, proxyUrl *url.URL, all
 
 	conn, err := dialer.Dial("tcp", proxyHost)
 	if err != nil {
-		responseMessage := fmt.Sprintf("HTTP_PROXY_ERR dial failed (%s)", err)
-		return nil, errors.New(responseMessage)
+		return nil, fmt.Errorf("HTTP_PROXY_ERR dial failed (%w)", err)
 	}
+	conn.SetDeadline(time.Now().Add(proxyHandshakeTimeout))
 
 	if isSecure {
 		proxyTlsConfig := &tls.Config{}
@@ -54,6 +60,7 @@ func DialAddrViaHttpProxy(dialer net.Dialer, addr string, proxyUrl *url.URL, all
 		} else {
 			sn, _, err := net.SplitHostPort(proxyHost)
 			if err != nil {
+				conn.Close()
 				responseMessage := fmt.Sprintf("HTTP_PROXY_ERR invalid proxy host format: '%s' (%s)", proxyHost, err)
 				return nil, errors.New(responseMessage)
 			}
@@ -66,6 +73,7 @@ func DialAddrViaHttpProxy(dialer net.Dialer, addr string, proxyUrl *url.URL, all
 
 	err = connectReq.Write(conn)
 	if err != nil {
+		conn.Close()
 		responseMessage := fmt.Sprintf("HTTP_PROXY_ERR writing CONNECT request failed (%s)", err)
 		return nil, errors.New(responseMessage)
 	}
@@ -85,12 +93,14 @@ func DialAddrViaHttpProxy(dialer net.Dialer, addr string, proxyUrl *url.URL, all
 	if resp.StatusCode != 200 {
 		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 500))
 		if err != nil {
+			conn.Close()
 			return nil, err
 		}
 		conn.Close()
 		responseMessage := fmt.Sprintf("HTTP_PROXY_ERR connection refused (%d)\n%s", resp.StatusCode, string(body))
 		return nil, errors.New(responseMessage)
 	}
+	conn.SetDeadline(time.Time{})
 	return conn, nil
 }
 
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
@@ -10,7 +11,7 @@ import (
 	"golang.org/x/net/proxy"
 )
 
-func DialAddrViaSock5Proxy(dialer net.Dialer, addr string, proxyUrl *url.URL) (net.Conn, error) {
+func DialAddrViaSock5Proxy(dialer proxy.Dialer, addr string, proxyUrl *url.URL) (net.Conn, error) {
 	var socksAuth *proxy.Auth = nil
 
 	proxyHost := proxyUrl.Host
@@ -29,17 +30,19 @@ func DialAddrViaSock5Proxy(dialer net.Dialer, addr string, proxyUrl *url.URL) (n
 
 	fmt.Printf("Connecting via socks5 proxy %s to %s\n", proxyHost, addr)
 
-	socksDialer, err := proxy.SOCKS5("tcp", proxyHost, socksAuth, proxy.Direct)
+	socksDialer, err := proxy.SOCKS5("tcp", proxyHost, socksAuth, dialer)
 	if err != nil {
 		responseMessage := fmt.Sprintf("SOCKS5_PROXY_ERR connection failed (%s)", err)
 		return nil, errors.New(responseMessage)
 	}
 	fmt.Printf("Got socks5 dialer %s to %s\n", proxyHost, addr)
 
-	conn, err := socksDialer.Dial("tcp", addr)
+	// the socks dialer sets the deadline on the proxy connection during the handshake, and closes it on errors
+	ctx, cancel := context.WithTimeout(context.Background(), proxyHandshakeTimeout)
+	defer cancel()
+	conn, err := socksDialer.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
 	if err != nil {
-		responseMessage := fmt.Sprintf("SOCKS5_PROXY_ERR dial failed (%s)", err)
-		return nil, errors.New(responseMessage)
+		return nil, fmt.Errorf("SOCKS5_PROXY_ERR dial failed (%w)", err)
 	}
 
 	return conn, nil
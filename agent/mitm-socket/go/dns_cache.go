@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultDnsCacheSize = 1000
+
+// the system resolver doesn't expose record ttls. Chrome caches its answers for a minute.
+const systemDnsTtl = time.Minute
+
+// not found answers without an SOA record, and from the system resolver
+const defaultNegativeDnsTtl = 15 * time.Second
+
+// lookups continue after the connection that started them is done, so other connections can use the answer
+const dnsLookupTimeout = 15 * time.Second
+
+// DnsCache is shared by all connections of a session. Answers are kept for their record ttl (least recently used
+// are evicted first), and not found answers are cached too. Concurrent lookups of a host share one query.
+type DnsCache struct {
+	sync.Mutex
+	resolver Resolver
+	entries  map[string]*dnsCacheEntry
+	keys     []string
+	capacity int
+	pending  map[string]*pendingLookup
+}
+
+type dnsCacheEntry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+type pendingLookup struct {
+	done  chan struct{}
+	entry *dnsCacheEntry
+}
+
+func NewDnsCache(resolver Resolver, capacity int) *DnsCache {
+	if capacity < 1 {
+		capacity = defaultDnsCacheSize
+	}
+	return &DnsCache{
+		resolver: resolver,
+		entries:  make(map[string]*dnsCacheEntry),
+		capacity: capacity,
+		pending:  make(map[string]*pendingLookup),
+	}
+}
+
+func (c *DnsCache) LookupIP(ctx context.Context, network string, host string) ([]net.IP, error) {
+	key := network + " " + strings.ToLower(host)
+
+	c.Lock()
+	if entry, ok := c.entries[key]; ok {
+		if time.Now().Before(entry.expires) {
+			c.touch(key)
+			c.Unlock()
+			return entry.ips, entry.err
+		}
+		c.remove(key)
+	}
+	pending, ok := c.pending[key]
+	if !ok {
+		pending = &pendingLookup{done: make(chan struct{})}
+		c.pending[key] = pending
+		go c.lookup(ctx, key, network, host, pending)
+	}
+	c.Unlock()
+
+	select {
+	case <-pending.done:
+		return pending.entry.ips, pending.entry.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *DnsCache) lookup(ctx context.Context, key string, network string, host string, pending *pendingLookup) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), dnsLookupTimeout)
+	defer cancel()
+
+	entry := &dnsCacheEntry{}
+	var ttl time.Duration
+	if resolver, ok := c.resolver.(ttlResolver); ok {
+		entry.ips, ttl, entry.err = resolver.lookupIPTtl(ctx, network, host)
+	} else {
+		entry.ips, entry.err = c.resolver.LookupIP(ctx, network, host)
+		ttl = systemDnsTtl
+		if entry.err != nil {
+			ttl = defaultNegativeDnsTtl
+		}
+	}
+	entry.expires = time.Now().Add(ttl)
+	pending.entry = entry
+
+	c.Lock()
+	delete(c.pending, key)
+	// failures to reach the resolver are not cached
+	var dnsErr *net.DNSError
+	if ttl > 0 && (entry.err == nil || errors.As(entry.err, &dnsErr) && dnsErr.IsNotFound) {
+		c.put(key, entry)
+	}
+	c.Unlock()
+	close(pending.done)
+}
+
+func (c *DnsCache) put(key string, entry *dnsCacheEntry) {
+	if _, exists := c.entries[key]; exists {
+		c.removeKey(key)
+	}
+	// evict least recently used
+	if len(c.keys) >= c.capacity {
+		delete(c.entries, c.keys[0])
+		c.keys = c.keys[1:]
+	}
+	c.entries[key] = entry
+	c.keys = append(c.keys, key)
+}
+
+func (c *DnsCache) touch(key string) {
+	c.removeKey(key)
+	c.keys = append(c.keys, key)
+}
+
+func (c *DnsCache) remove(key string) {
+	delete(c.entries, key)
+	c.removeKey(key)
+}
+
+func (c *DnsCache) removeKey(key string) {
+	for i, existing := range c.keys {
+		if existing == key {
+			c.keys = append(c.keys[:i], c.keys[i+1:]...)
+			return
+		}
+	}
+}
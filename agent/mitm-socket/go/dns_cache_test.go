@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testTtlResolver answers like a stub resolver that knows record ttls
+type testTtlResolver struct {
+	testResolver
+	ttl time.Duration
+}
+
+func (r *testTtlResolver) lookupIPTtl(ctx context.Context, network string, host string) ([]net.IP, time.Duration, error) {
+	ips, err := r.LookupIP(ctx, network, host)
+	return ips, r.ttl, err
+}
+
+func lookupTest(t *testing.T, cache *DnsCache, host string) ([]net.IP, error) {
+	t.Helper()
+	return cache.LookupIP(context.Background(), "ip4", host)
+}
+
+func TestDnsCacheHonoursTtl(t *testing.T) {
+	resolver := &testTtlResolver{ttl: 100 * time.Millisecond}
+	resolver.answer = func(network string, host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("192.0.2.1")}, nil
+	}
+	cache := NewDnsCache(resolver, 0)
+
+	for range 3 {
+		if ips, err := lookupTest(t, cache, "cached.example.com"); err != nil || len(ips) != 1 {
+			t.Fatalf("expected the answer, got %v %v", ips, err)
+		}
+	}
+	// hostnames are case insensitive
+	lookupTest(t, cache, "CACHED.example.com")
+	if resolver.lookups.Load() != 1 {
+		t.Fatalf("expected one query within the ttl, got %d", resolver.lookups.Load())
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	lookupTest(t, cache, "cached.example.com")
+	if resolver.lookups.Load() != 2 {
+		t.Fatalf("expected a new query after the ttl, got %d", resolver.lookups.Load())
+	}
+
+	// a zero ttl answer isn't cached
+	resolver.ttl = 0
+	lookupTest(t, cache, "uncached.example.com")
+	lookupTest(t, cache, "uncached.example.com")
+	if resolver.lookups.Load() != 4 {
+		t.Fatalf("expected zero ttl answers to be queried again, got %d", resolver.lookups.Load())
+	}
+}
+
+func TestDnsCacheNegativeAnswers(t *testing.T) {
+	resolver := &testTtlResolver{ttl: time.Minute}
+	resolver.answer = func(network string, host string) ([]net.IP, error) {
+		if host == "missing.example.com" {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return nil, &net.DNSError{Err: "i/o timeout", Name: host, IsTimeout: true}
+	}
+	cache := NewDnsCache(resolver, 0)
+
+	for range 2 {
+		var dnsErr *net.DNSError
+		if _, err := lookupTest(t, cache, "missing.example.com"); !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			t.Fatalf("expected a not found error, got %v", err)
+		}
+	}
+	if resolver.lookups.Load() != 1 {
+		t.Fatalf("expected the not found answer to be cached, got %d queries", resolver.lookups.Load())
+	}
+
+	// failures to reach the resolver are retried
+	lookupTest(t, cache, "timeout.example.com")
+	lookupTest(t, cache, "timeout.example.com")
+	if resolver.lookups.Load() != 3 {
+		t.Fatalf("expected resolver failures not to be cached, got %d queries", resolver.lookups.Load())
+	}
+}
+
+func TestDnsCacheSystemResolver(t *testing.T) {
+	resolver := &testResolver{answer: func(network string, host string) ([]net.IP, error) {
+		if host == "broken.example.com" {
+			return nil, errors.New("connection refused")
+		}
+		return []net.IP{net.ParseIP("192.0.2.1")}, nil
+	}}
+	cache := NewDnsCache(resolver, 0)
+
+	lookupTest(t, cache, "system.example.com")
+	lookupTest(t, cache, "system.example.com")
+	lookupTest(t, cache, "broken.example.com")
+	lookupTest(t, cache, "broken.example.com")
+	if resolver.lookups.Load() != 3 {
+		t.Fatalf("expected system answers to be cached and errors to be retried, got %d queries", resolver.lookups.Load())
+	}
+}
+
+func TestDnsCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	resolver := &testTtlResolver{ttl: time.Minute}
+	resolver.answer = func(network string, host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("192.0.2.1")}, nil
+	}
+	cache := NewDnsCache(resolver, 2)
+
+	lookupTest(t, cache, "a.example.com")
+	lookupTest(t, cache, "b.example.com")
+	lookupTest(t, cache, "a.example.com")
+	lookupTest(t, cache, "c.example.com")
+	if resolver.lookups.Load() != 3 {
+		t.Fatalf("expected 3 queries, got %d", resolver.lookups.Load())
+	}
+	lookupTest(t, cache, "a.example.com")
+	if resolver.lookups.Load() != 3 {
+		t.Fatal("expected the recently used host to stay cached")
+	}
+	lookupTest(t, cache, "b.example.com")
+	if resolver.lookups.Load() != 4 {
+		t.Fatal("expected the least recently used host to be evicted")
+	}
+}
+
+func TestDnsCacheSharesConcurrentLookups(t *testing.T) {
+	release := make(chan struct{})
+	resolver := &testTtlResolver{ttl: time.Minute}
+	resolver.answer = func(network string, host string) ([]net.IP, error) {
+		<-release
+		return []net.IP{net.ParseIP("192.0.2.1")}, nil
+	}
+	cache := NewDnsCache(resolver, 0)
+
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ips, err := cache.LookupIP(context.Background(), "ip4", "shared.example.com"); err != nil || len(ips) != 1 {
+				t.Errorf("expected the shared answer, got %v %v", ips, err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if resolver.lookups.Load() != 1 {
+		t.Fatalf("expected one query for concurrent lookups, got %d", resolver.lookups.Load())
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	DnsResolverSystem = "system"
+	DnsResolverUdp    = "udp"
+	DnsResolverTcp    = "tcp"
+	DnsResolverDoh    = "doh"
+	DnsResolverDot    = "dot"
+)
+
+const dnsQueryTimeout = 5 * time.Second
+
+// DnsResolverConfig selects how hostnames of direct connections are resolved. Proxies resolve hostnames themselves.
+type DnsResolverConfig struct {
+	// system (default), udp, tcp, doh (DNS-over-HTTPS) or dot (DNS-over-TLS)
+	Type string
+	// host:port for udp, tcp and dot (port defaults to 53 or 853). An https url for doh, eg, https://1.1.1.1/dns-query
+	Server string
+	// dot: name to verify the server certificate for when Server is an ip address
+	ServerName string
+	// use the system resolver when the server can't be reached (Chrome's "automatic" Secure DNS mode). Off by
+	// default, so no queries leak to the system resolver.
+	FallbackToSystem bool
+}
+
+// Resolver is implemented by net.Resolver
+type Resolver interface {
+	LookupIP(ctx context.Context, network string, host string) ([]net.IP, error)
+}
+
+// ttlResolver is implemented by resolvers that know the ttl of the records they return
+type ttlResolver interface {
+	lookupIPTtl(ctx context.Context, network string, host string) ([]net.IP, time.Duration, error)
+}
+
+var dnsResolver Resolver = net.DefaultResolver
+
+// looks up ECHConfigLists in HTTPS records. The session resolver if it isn't the system resolver, or EchDnsServer.
+var echResolver *stubResolver
+
+// stubResolver sends A and AAAA queries to a recursive resolver
+type stubResolver struct {
+	config     DnsResolverConfig
+	tlsConfig  *tls.Config
+	httpClient *http.Client
+	// queries leave from the session local address, device and mark like connections do
+	binding *socketBinding
+}
+
+// InitDnsResolver configures the resolver, cache and host resolver rules used by Dial
+func InitDnsResolver(sessionArgs SessionArgs) error {
+	rules, err := ParseHostResolverRules(sessionArgs.HostResolverRules)
+	if err != nil {
+		return err
+	}
+	hostResolverRules = rules
+
+	binding, err := getSocketBinding(ConnectArgs{}, sessionArgs)
+	if err != nil {
+		return err
+	}
+	resolver, err := newResolver(sessionArgs.DnsResolver, binding)
+	if err != nil {
+		return err
+	}
+	if sessionArgs.DisableDnsCache {
+		dnsResolver = resolver
+	} else {
+		dnsResolver = NewDnsCache(resolver, sessionArgs.DnsCacheSize)
+	}
+
+	// the system resolver can't look up HTTPS records
+	if stub, ok := resolver.(*stubResolver); ok {
+		echResolver = stub
+	} else if sessionArgs.EchDnsServer != "" {
+		resolver, err = newResolver(&DnsResolverConfig{Type: DnsResolverUdp, Server: sessionArgs.EchDnsServer}, binding)
+		if err != nil {
+			return err
+		}
+		echResolver = resolver.(*stubResolver)
+	}
+	if echResolver != nil && !sessionArgs.DisableDnsCache {
+		echConfigCache = NewEchConfigCache(sessionArgs.DnsCacheSize)
+	}
+	return nil
+}
+
+func newResolver(config *DnsResolverConfig, binding *socketBinding) (Resolver, error) {
+	if config == nil || config.Type == "" || config.Type == DnsResolverSystem {
+		return net.DefaultResolver, nil
+	}
+
+	resolver := &stubResolver{config: *config, binding: binding}
+	switch config.Type {
+	case DnsResolverUdp, DnsResolverTcp, DnsResolverDot:
+		if config.Server == "" {
+			return nil, fmt.Errorf("DnsResolver %s needs a Server", config.Type)
+		}
+		if _, _, err := net.SplitHostPort(config.Server); err != nil {
+			port := "53"
+			if config.Type == DnsResolverDot {
+				port = "853"
+			}
+			resolver.config.Server = net.JoinHostPort(config.Server, port)
+		}
+		if config.Type == DnsResolverDot {
+			serverName := config.ServerName
+			if serverName == "" {
+				serverName, _, _ = net.SplitHostPort(resolver.config.Server)
+			}
+			resolver.tlsConfig = &tls.Config{ServerName: serverName, RootCAs: rootCas, MinVersion: tls.VersionTLS12}
+		}
+
+	case DnsResolverDoh:
+		serverUrl, err := url.Parse(config.Server)
+		if err != nil || serverUrl.Scheme != "https" || serverUrl.Host == "" {
+			return nil, fmt.Errorf("DnsResolver doh needs an https Server url (%s)", config.Server)
+		}
+		resolver.tlsConfig = &tls.Config{RootCAs: rootCas, MinVersion: tls.VersionTLS12}
+		resolver.httpClient = &http.Client{
+			Timeout: dnsQueryTimeout,
+			// a doh server hostname is bootstrapped with the system resolver
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+					return binding.dialer(network).DialContext(ctx, network, addr)
+				},
+				TLSClientConfig:   resolver.tlsConfig,
+				ForceAttemptHTTP2: true,
+				IdleConnTimeout:   90 * time.Second,
+			},
+		}
+
+	default:
+		return nil, fmt.Errorf("Unsupported DnsResolver type %s", config.Type)
+	}
+
+	return resolver, nil
+}
+
+func (r *stubResolver) LookupIP(ctx context.Context, network string, host string) ([]net.IP, error) {
+	ips, _, err := r.lookupIPTtl(ctx, network, host)
+	return ips, err
+}
+
+// lookupIPTtl also returns how long the answer can be cached. Negative answers use the SOA ttl (RFC 2308).
+func (r *stubResolver) lookupIPTtl(ctx context.Context, network string, host string) ([]net.IP, time.Duration, error) {
+	ips, ttl, err := r.query(ctx, network, host)
+	if err != nil && r.config.FallbackToSystem {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			ips, err = net.DefaultResolver.LookupIP(ctx, network, host)
+			return ips, systemDnsTtl, err
+		}
+	}
+	return ips, ttl, err
+}
+
+func (r *stubResolver) query(ctx context.Context, network string, host string) ([]net.IP, time.Duration, error) {
+	queryType := dnsmessage.TypeA
+	if network == "ip6" {
+		queryType = dnsmessage.TypeAAAA
+	}
+	response, err := r.exchangeQuery(ctx, host, queryType)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var ips []net.IP
+	// the lowest ttl of the answer chain (cnames and addresses)
+	var ttl uint32
+	for i, answer := range response.Answers {
+		if i == 0 || answer.Header.TTL < ttl {
+			ttl = answer.Header.TTL
+		}
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			if queryType == dnsmessage.TypeA {
+				ips = append(ips, net.IP(body.A[:]))
+			}
+		case *dnsmessage.AAAAResource:
+			if queryType == dnsmessage.TypeAAAA {
+				ips = append(ips, net.IP(body.AAAA[:]))
+			}
+		}
+	}
+	if response.Header.RCode == dnsmessage.RCodeNameError || len(ips) == 0 {
+		return nil, negativeDnsTtl(response), &net.DNSError{Err: "no such host", Name: host, Server: r.config.Server, IsNotFound: true}
+	}
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+// lookupHttps returns the HTTPS resource records (RFC 9460) of a name, which carry ECHConfigLists, and how long the
+// answer can be cached
+func (r *stubResolver) lookupHttps(ctx context.Context, name string) ([]dnsmessage.Resource, time.Duration, error) {
+	response, err := r.exchangeQuery(ctx, name, dnsTypeHTTPS)
+	if err != nil {
+		return nil, 0, err
+	}
+	var records []dnsmessage.Resource
+	var ttl uint32
+	for _, answer := range response.Answers {
+		if answer.Header.Type == dnsTypeHTTPS {
+			if len(records) == 0 || answer.Header.TTL < ttl {
+				ttl = answer.Header.TTL
+			}
+			records = append(records, answer)
+		}
+	}
+	if len(records) == 0 {
+		return nil, negativeDnsTtl(response), nil
+	}
+	return records, time.Duration(ttl) * time.Second, nil
+}
+
+// exchangeQuery sends a question to the server. Not found (NXDOMAIN) responses are returned without an error.
+func (r *stubResolver) exchangeQuery(ctx context.Context, host string, queryType dnsmessage.Type) (*dnsmessage.Message, error) {
+	name := host
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	questionName, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+	// an unpredictable id makes spoofed udp responses harder to get accepted
+	var id [2]byte
+	if _, err = rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: binary.BigEndian.Uint16(id[:]), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  questionName,
+			Type:  queryType,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	// doh uses id 0 so responses can be cached by http caches (RFC 8484 section 4.1)
+	if r.config.Type == DnsResolverDoh {
+		query.Header.ID = 0
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := r.exchange(ctx, packed)
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: host, Server: r.config.Server}
+	}
+	if response.Header.ID != query.Header.ID {
+		return nil, &net.DNSError{Err: "DNS response id mismatch", Name: host, Server: r.config.Server}
+	}
+	if response.Header.RCode != dnsmessage.RCodeSuccess && response.Header.RCode != dnsmessage.RCodeNameError {
+		return nil, &net.DNSError{Err: fmt.Sprintf("server responded %s", response.Header.RCode), Name: host, Server: r.config.Server}
+	}
+	return response, nil
+}
+
+// negativeDnsTtl is the lower of the SOA record ttl and its minimum field (RFC 2308 section 5)
+func negativeDnsTtl(response *dnsmessage.Message) time.Duration {
+	for _, authority := range response.Authorities {
+		if soa, ok := authority.Body.(*dnsmessage.SOAResource); ok {
+			return time.Duration(min(authority.Header.TTL, soa.MinTTL)) * time.Second
+		}
+	}
+	return defaultNegativeDnsTtl
+}
+
+func (r *stubResolver) exchange(ctx context.Context, packed []byte) (*dnsmessage.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, dnsQueryTimeout)
+	defer cancel()
+
+	if r.config.Type == DnsResolverDoh {
+		return r.exchangeHttps(ctx, packed)
+	}
+
+	var dnsConn net.Conn
+	var err error
+	switch r.config.Type {
+	case DnsResolverDot:
+		tlsDialer := tls.Dialer{NetDialer: r.binding.dialer("tcp"), Config: r.tlsConfig}
+		dnsConn, err = tlsDialer.DialContext(ctx, "tcp", r.config.Server)
+	default:
+		dnsConn, err = r.binding.dialer(r.config.Type).DialContext(ctx, r.config.Type, r.config.Server)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer dnsConn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		dnsConn.SetDeadline(deadline)
+	}
+
+	response, err := exchangeDnsConn(dnsConn, packed, r.config.Type != DnsResolverUdp)
+	if err == nil && response.Header.Truncated && r.config.Type == DnsResolverUdp {
+		tcpConn, err := r.binding.dialer("tcp").DialContext(ctx, "tcp", r.config.Server)
+		if err != nil {
+			return nil, err
+		}
+		defer tcpConn.Close()
+		if deadline, ok := ctx.Deadline(); ok {
+			tcpConn.SetDeadline(deadline)
+		}
+		return exchangeDnsConn(tcpConn, packed, true)
+	}
+	return response, err
+}
+
+// exchangeHttps posts the query as an application/dns-message (RFC 8484)
+func (r *stubResolver) exchangeHttps(ctx context.Context, packed []byte) (*dnsmessage.Message, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, r.config.Server, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/dns-message")
+	request.Header.Set("Accept", "application/dns-message")
+
+	httpResponse, err := r.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS-over-HTTPS server responded %s", httpResponse.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(httpResponse.Body, 65535))
+	if err != nil {
+		return nil, err
+	}
+	response := &dnsmessage.Message{}
+	err = response.Unpack(body)
+	return response, err
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testDnsServer answers udp and tcp queries on the same port with the response of handle
+type testDnsServer struct {
+	sync.Mutex
+	addr    string
+	queries atomic.Int32
+	handle  func(query *dnsmessage.Message, isTcp bool) *dnsmessage.Message
+	// source ips of the queries
+	sourceIps []string
+}
+
+func startTestDnsServer(t *testing.T, handle func(query *dnsmessage.Message, isTcp bool) *dnsmessage.Message) *testDnsServer {
+	t.Helper()
+	var udpConn net.PacketConn
+	var tcpListener net.Listener
+	var err error
+	// the tcp port can be taken by another process
+	for range 10 {
+		udpConn, err = net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tcpListener, err = net.Listen("tcp", udpConn.LocalAddr().String())
+		if err == nil {
+			break
+		}
+		udpConn.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { udpConn.Close() })
+
+	server := &testDnsServer{addr: udpConn.LocalAddr().String(), handle: handle}
+	go func() {
+		buffer := make([]byte, 65535)
+		for {
+			n, addr, err := udpConn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			server.addSource(addr)
+			if response := server.respond(buffer[:n], false); response != nil {
+				udpConn.WriteTo(response, addr)
+			}
+		}
+	}()
+	serveTest(t, tcpListener, func(conn net.Conn) {
+		var length uint16
+		if binary.Read(conn, binary.BigEndian, &length) != nil {
+			return
+		}
+		packed := make([]byte, length)
+		if _, err := io.ReadFull(conn, packed); err != nil {
+			return
+		}
+		server.addSource(conn.RemoteAddr())
+		if response := server.respond(packed, true); response != nil {
+			conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(response))), response...))
+		}
+	})
+	return server
+}
+
+func (s *testDnsServer) addSource(addr net.Addr) {
+	host, _, _ := net.SplitHostPort(addr.String())
+	s.Lock()
+	s.sourceIps = append(s.sourceIps, host)
+	s.Unlock()
+}
+
+func (s *testDnsServer) respond(packed []byte, isTcp bool) []byte {
+	s.queries.Add(1)
+	query := &dnsmessage.Message{}
+	if query.Unpack(packed) != nil {
+		return nil
+	}
+	response := s.handle(query, isTcp)
+	response.Header.Response = true
+	response.Questions = query.Questions
+	packed, err := response.Pack()
+	if err != nil {
+		panic(err)
+	}
+	return packed
+}
+
+func newTestStubResolver(t *testing.T, resolverType string, server string) *stubResolver {
+	t.Helper()
+	resolver, err := newResolver(&DnsResolverConfig{Type: resolverType, Server: server}, &socketBinding{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resolver.(*stubResolver)
+}
+
+func aRecord(query *dnsmessage.Message, ip string, ttl uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: query.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   &dnsmessage.AResource{A: [4]byte(net.ParseIP(ip).To4())},
+	}
+}
+
+func TestDnsTruncatedUdpFallsBackToTcp(t *testing.T) {
+	server := startTestDnsServer(t, func(query *dnsmessage.Message, isTcp bool) *dnsmessage.Message {
+		response := &dnsmessage.Message{Header: dnsmessage.Header{ID: query.ID}}
+		if !isTcp {
+			response.Truncated = true
+			return response
+		}
+		response.Answers = []dnsmessage.Resource{aRecord(query, "192.0.2.1", 300), aRecord(query, "192.0.2.2", 120)}
+		return response
+	})
+	resolver := newTestStubResolver(t, DnsResolverUdp, server.addr)
+
+	ips, ttl, err := resolver.lookupIPTtl(context.Background(), "ip4", "truncated.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 2 || !ips[0].Equal(net.ParseIP("192.0.2.1")) {
+		t.Fatalf("expected the tcp answers, got %v", ips)
+	}
+	if ttl != 120*time.Second {
+		t.Fatalf("expected the lowest answer ttl, got %s", ttl)
+	}
+	if server.queries.Load() != 2 {
+		t.Fatalf("expected a udp and a tcp query, got %d", server.queries.Load())
+	}
+}
+
+func TestDnsQueriesUseSessionLocalAddress(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("binding to 127.0.0.2 needs the linux loopback /8")
+	}
+	server := startTestDnsServer(t, func(query *dnsmessage.Message, isTcp bool) *dnsmessage.Message {
+		response := &dnsmessage.Message{Header: dnsmessage.Header{ID: query.ID, Truncated: !isTcp}}
+		if isTcp {
+			response.Answers = []dnsmessage.Resource{aRecord(query, "192.0.2.1", 300)}
+		}
+		return response
+	})
+	binding, err := getSocketBinding(ConnectArgs{}, SessionArgs{LocalAddress: "127.0.0.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver, err := newResolver(&DnsResolverConfig{Type: DnsResolverUdp, Server: server.addr}, binding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = resolver.LookupIP(context.Background(), "ip4", "bound.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	server.Lock()
+	defer server.Unlock()
+	if len(server.sourceIps) != 2 || server.sourceIps[0] != "127.0.0.2" || server.sourceIps[1] != "127.0.0.2" {
+		t.Fatalf("expected udp and tcp queries from the local address, got %v", server.sourceIps)
+	}
+}
+
+func TestDnsNotFoundUsesSoaTtl(t *testing.T) {
+	server := startTestDnsServer(t, func(query *dnsmessage.Message, isTcp bool) *dnsmessage.Message {
+		return &dnsmessage.Message{
+			Header: dnsmessage.Header{ID: query.ID, RCode: dnsmessage.RCodeNameError},
+			Authorities: []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 600},
+				Body: &dnsmessage.SOAResource{
+					NS:     dnsmessage.MustNewName("ns.example.com."),
+					MBox:   dnsmessage.MustNewName("admin.example.com."),
+					MinTTL: 60,
+				},
+			}},
+		}
+	})
+	resolver := newTestStubResolver(t, DnsResolverTcp, server.addr)
+
+	_, ttl, err := resolver.lookupIPTtl(context.Background(), "ip4", "missing.example.com")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Fatalf("expected a not found error, got %v", err)
+	}
+	if ttl != 60*time.Second {
+		t.Fatalf("expected the SOA minimum ttl, got %s", ttl)
+	}
+}
+
+func TestDnsResponseIdMismatch(t *testing.T) {
+	server := startTestDnsServer(t, func(query *dnsmessage.Message, isTcp bool) *dnsmessage.Message {
+		return &dnsmessage.Message{
+			Header:  dnsmessage.Header{ID: query.ID + 1},
+			Answers: []dnsmessage.Resource{aRecord(query, "192.0.2.66", 300)},
+		}
+	})
+	resolver := newTestStubResolver(t, DnsResolverUdp, server.addr)
+
+	ips, err := resolver.LookupIP(context.Background(), "ip4", "spoofed.example.com")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || dnsErr.IsNotFound || !strings.Contains(dnsErr.Err, "id mismatch") {
+		t.Fatalf("expected an id mismatch error, got %v %v", ips, err)
+	}
+}
+
+func TestLookupEchConfigListFromHttpsRecord(t *testing.T) {
+	configList := []byte{0x00, 0x04, 0xfe, 0x0d, 0x00, 0x00}
+	queriedNames := make(chan string, 1)
+	server := startTestDnsServer(t, func(query *dnsmessage.Message, isTcp bool) *dnsmessage.Message {
+		queriedNames <- query.Questions[0].Name.String()
+		// priority 1, root target, ech param
+		data := []byte{0x00, 0x01, 0x00, 0x00, svcParamKeyEch}
+		data = binary.BigEndian.AppendUint16(data, uint16(len(configList)))
+		data = append(data, configList...)
+		return &dnsmessage.Message{
+			Header: dnsmessage.Header{ID: query.ID},
+			Answers: []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: query.Questions[0].Name, Type: dnsTypeHTTPS, Class: dnsmessage.ClassINET, TTL: 300},
+				Body:   &dnsmessage.UnknownResource{Type: dnsTypeHTTPS, Data: data},
+			}},
+		}
+	})
+	resolver := newTestStubResolver(t, DnsResolverTcp, server.addr)
+
+	result, ttl, err := LookupEchConfigList(context.Background(), resolver, "ech.example.com", "8443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, configList) {
+		t.Fatalf("expected the ech param, got %x", result)
+	}
+	if ttl != 300*time.Second {
+		t.Fatalf("expected the record ttl, got %s", ttl)
+	}
+	if queriedName := <-queriedNames; queriedName != "_8443._https.ech.example.com." {
+		t.Fatalf("expected the port prefixed name, got %s", queriedName)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	tls "github.com/refraction-networking/utls"
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	echStatusAccepted = "accepted"
+	echStatusGrease   = "grease"
+	echStatusRejected = "rejected"
+
+	dnsTypeHTTPS   = dnsmessage.Type(65)
+	svcParamKeyEch = 5
+)
+
+// EchResult is reported over ipc so callers can see if the ClientHelloInner was used by the server
+type EchResult struct {
+	Status string
+	// retry configs sent by the server when it rejected the ECHConfigList we used
+	RetryConfigs []byte
+}
+
+// getEchResult reports if the server accepted ECH or if GREASE ECH was sent. rejected is set if the connection was
+// retried after the server rejected the first ECHConfigList.
+func getEchResult(rejected *EchResult, tlsState tls.ConnectionState, rawClientHello []byte) *EchResult {
+	result := rejected
+	if tlsState.ECHAccepted {
+		if result == nil {
+			result = &EchResult{}
+		}
+		result.Status = echStatusAccepted
+	} else if result == nil && hasClientHelloExtension(rawClientHello, extensionEncryptedClientHello) {
+		result = &EchResult{Status: echStatusGrease}
+	}
+	return result
+}
+
+func hasEchExtension(spec *tls.ClientHelloSpec) bool {
+	for _, ext := range spec.Extensions {
+		if _, ok := ext.(tls.EncryptedClientHelloExtension); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// EchConfigCache keeps the ECHConfigLists looked up for a host and port for the ttl of their HTTPS record, so every
+// connection doesn't send a query. Hosts without an "ech" SvcParam are cached too.
+type EchConfigCache struct {
+	sync.Mutex
+	entries  map[string]*echConfigEntry
+	keys     []string
+	capacity int
+}
+
+type echConfigEntry struct {
+	configList []byte
+	expires    time.Time
+}
+
+var echConfigCache *EchConfigCache
+
+func NewEchConfigCache(capacity int) *EchConfigCache {
+	if capacity < 1 {
+		capacity = defaultDnsCacheSize
+	}
+	return &EchConfigCache{
+		entries:  make(map[string]*echConfigEntry),
+		capacity: capacity,
+	}
+}
+
+func (c *EchConfigCache) Get(key string) ([]byte, bool) {
+	c.Lock()
+	defer c.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !time.Now().Before(entry.expires) {
+		delete(c.entries, key)
+		c.removeKey(key)
+		return nil, false
+	}
+	return entry.configList, true
+}
+
+func (c *EchConfigCache) Put(key string, configList []byte, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if _, exists := c.entries[key]; exists {
+		c.removeKey(key)
+	}
+	// evict oldest
+	if len(c.keys) >= c.capacity {
+		delete(c.entries, c.keys[0])
+		c.keys = c.keys[1:]
+	}
+	c.entries[key] = &echConfigEntry{configList: configList, expires: time.Now().Add(ttl)}
+	c.keys = append(c.keys, key)
+}
+
+func (c *EchConfigCache) removeKey(key string) {
+	for i, existing := range c.keys {
+		if existing == key {
+			c.keys = append(c.keys[:i], c.keys[i+1:]...)
+			return
+		}
+	}
+}
+
+// GetEchConfigList returns the ECHConfigList sent in through ConnectArgs, or looks it up in the DNS HTTPS record
+// of the host if a resolver is configured. Returns nil if no config is available (GREASE ECH will be used).
+func GetEchConfigList(connectArgs ConnectArgs) ([]byte, error) {
+	if connectArgs.EchConfigList != "" {
+		configList, err := base64.StdEncoding.DecodeString(connectArgs.EchConfigList)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid EchConfigList (%s)", err)
+		}
+		return configList, nil
+	}
+
+	if echResolver == nil {
+		return nil, nil
+	}
+
+	host := connectHost(connectArgs)
+	if net.ParseIP(host) != nil {
+		return nil, nil
+	}
+
+	key := net.JoinHostPort(strings.ToLower(host), connectArgs.Port)
+	if echConfigCache != nil {
+		if configList, ok := echConfigCache.Get(key); ok {
+			return configList, nil
+		}
+	}
+	configList, ttl, err := LookupEchConfigList(context.Background(), echResolver, host, connectArgs.Port)
+	if err != nil {
+		// failures to reach the resolver are not cached
+		return nil, err
+	}
+	if echConfigCache != nil {
+		echConfigCache.Put(key, configList, ttl)
+	}
+	return configList, nil
+}
+
+// LookupEchConfigList queries the HTTPS resource record of a host (RFC 9460) and returns the "ech" SvcParam, and
+// how long it can be cached
+func LookupEchConfigList(ctx context.Context, resolver *stubResolver, host string, port string) ([]byte, time.Duration, error) {
+	// non-default ports use a prefixed owner name (eg, _8443._https.example.com)
+	name := host
+	if port != "" && port != "443" {
+		name = fmt.Sprintf("_%s._https.%s", port, host)
+	}
+
+	records, ttl, err := resolver.lookupHttps(ctx, name)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, record := range records {
+		unknown, ok := record.Body.(*dnsmessage.UnknownResource)
+		if !ok {
+			continue
+		}
+		configList, err := parseHttpsRecordEch(unknown.Data)
+		if err != nil {
+			return nil, 0, err
+		}
+		if configList != nil {
+			return configList, ttl, nil
+		}
+	}
+	return nil, ttl, nil
+}
+
+// exchangeDnsConn sends a query over an open connection. Stream connections (tcp, tls) prefix messages with a length.
+func exchangeDnsConn(dnsConn net.Conn, packed []byte, isStream bool) (*dnsmessage.Message, error) {
+	if isStream {
+		packed = append([]byte{byte(len(packed) >> 8), byte(len(packed))}, packed...)
+	}
+	if _, err := dnsConn.Write(packed); err != nil {
+		return nil, err
+	}
+
+	buffer := make([]byte, 65535)
+	var n int
+	var err error
+	if isStream {
+		var length [2]byte
+		if _, err = io.ReadFull(dnsConn, length[:]); err != nil {
+			return nil, err
+		}
+		n, err = io.ReadFull(dnsConn, buffer[:int(length[0])<<8|int(length[1])])
+	} else {
+		n, err = dnsConn.Read(buffer)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	response := &dnsmessage.Message{}
+	err = response.Unpack(buffer[:n])
+	return response, err
+}
+
+// parseHttpsRecordEch reads the ech SvcParam out of an HTTPS record: priority, target name, then key/value params
+func parseHttpsRecordEch(data []byte) ([]byte, error) {
+	s := cryptobyte.String(data)
+	var priority uint16
+	if !s.ReadUint16(&priority) {
+		return nil, errors.New("Malformed HTTPS record")
+	}
+	// target names are never compressed
+	for {
+		var label cryptobyte.String
+		if !s.ReadUint8LengthPrefixed(&label) {
+			return nil, errors.New("Malformed HTTPS record target")
+		}
+		if len(label) == 0 {
+			break
+		}
+	}
+
+	for !s.Empty() {
+		var key uint16
+		var value cryptobyte.String
+		if !s.ReadUint16(&key) || !s.ReadUint16LengthPrefixed(&value) {
+			return nil, errors.New("Malformed HTTPS record params")
+		}
+		if key == svcParamKeyEch {
+			return []byte(value), nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	stdtls "crypto/tls"
+	"encoding/binary"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+
+	tls "github.com/refraction-networking/utls"
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// newEchKey creates an X25519/HKDF-SHA256/AES-128-GCM ECHConfig (draft-ietf-tls-esni section 4)
+func newEchKey(t *testing.T, configId uint8, publicName string) stdtls.EncryptedClientHelloKey {
+	t.Helper()
+	privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config cryptobyte.Builder
+	config.AddUint16(0xfe0d)
+	config.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint8(configId)
+		b.AddUint16(0x0020) // DHKEM(X25519, HKDF-SHA256)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(privateKey.PublicKey().Bytes()) })
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16(0x0001) // HKDF-SHA256
+			b.AddUint16(0x0001) // AES-128-GCM
+		})
+		b.AddUint8(0)
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte(publicName)) })
+		b.AddUint16(0)
+	})
+	return stdtls.EncryptedClientHelloKey{Config: config.BytesOrPanic(), PrivateKey: privateKey.Bytes(), SendAsRetry: true}
+}
+
+func echConfigList(keys ...stdtls.EncryptedClientHelloKey) []byte {
+	var list cryptobyte.Builder
+	list.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, key := range keys {
+			b.AddBytes(key.Config)
+		}
+	})
+	return list.BytesOrPanic()
+}
+
+// startEchServer serves tls 1.3 with the ECH keys and returns its address. Chrome sends the ECH extension since 117.
+func startEchServer(t *testing.T, keys []stdtls.EncryptedClientHelloKey) string {
+	addr, _ := startTestTlsServer(t, func(config *stdtls.Config) {
+		config.MinVersion = stdtls.VersionTLS13
+		config.EncryptedClientHelloKeys = keys
+	})
+	return addr
+}
+
+func TestEchAccepted(t *testing.T) {
+	key := newEchKey(t, 1, "public.example.com")
+	addr := startEchServer(t, []stdtls.EncryptedClientHelloKey{key})
+
+	uTlsConn, err := emulateTestConnection(t, addr, SessionArgs{}, echConfigList(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := getEchResult(nil, uTlsConn.ConnectionState(), uTlsConn.HandshakeState.Hello.Raw)
+	if result == nil || result.Status != echStatusAccepted {
+		t.Fatalf("expected ECH to be accepted, got %+v", result)
+	}
+}
+
+func TestEchGrease(t *testing.T) {
+	key := newEchKey(t, 1, "public.example.com")
+	addr := startEchServer(t, []stdtls.EncryptedClientHelloKey{key})
+
+	uTlsConn, err := emulateTestConnection(t, addr, SessionArgs{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := getEchResult(nil, uTlsConn.ConnectionState(), uTlsConn.HandshakeState.Hello.Raw)
+	if result == nil || result.Status != echStatusGrease {
+		t.Fatalf("expected GREASE ECH, got %+v", result)
+	}
+}
+
+func TestEchRetryConfigs(t *testing.T) {
+	staleKey := newEchKey(t, 1, "public.example.com")
+	key := newEchKey(t, 2, "public.example.com")
+	addr := startEchServer(t, []stdtls.EncryptedClientHelloKey{key})
+
+	_, err := emulateTestConnection(t, addr, SessionArgs{}, echConfigList(staleKey))
+	var echRejection *tls.ECHRejectionError
+	if !errors.As(err, &echRejection) {
+		t.Fatalf("expected the stale config to be rejected, got %v", err)
+	}
+	if !bytes.Equal(echRejection.RetryConfigList, echConfigList(key)) {
+		t.Fatalf("expected the server config as retry config, got %x", echRejection.RetryConfigList)
+	}
+
+	rejected := &EchResult{Status: echStatusRejected, RetryConfigs: echRejection.RetryConfigList}
+	uTlsConn, err := emulateTestConnection(t, addr, SessionArgs{}, rejected.RetryConfigs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := getEchResult(rejected, uTlsConn.ConnectionState(), uTlsConn.HandshakeState.Hello.Raw)
+	if result.Status != echStatusAccepted || result.RetryConfigs == nil {
+		t.Fatalf("expected the retry to be accepted, got %+v", result)
+	}
+}
+
+func TestEchConfigListOnlyLookedUpWithEchExtension(t *testing.T) {
+	addr, _ := startTestTlsServer(t, nil)
+	withoutEch := parseTestDefinition(t, chromeLikeDefinition)
+	withoutEch.Extensions = slices.DeleteFunc(withoutEch.Extensions, func(ext ClientHelloExtensionDefinition) bool {
+		return ext.Id == extensionEncryptedClientHello
+	})
+
+	for _, test := range []struct {
+		name       string
+		definition *ClientHelloDefinition
+		lookups    int
+	}{
+		{"with ech", parseTestDefinition(t, chromeLikeDefinition), 1},
+		{"without ech", withoutEch, 0},
+	} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lookups := 0
+		getEchConfigList := func() []byte {
+			lookups++
+			return nil
+		}
+		connectArgs := ConnectArgs{Host: "127.0.0.1", Servername: "ech.example.com"}
+		_, _, err = EmulateTls(conn, addr, SessionArgs{ClientHelloSpec: test.definition}, connectArgs, getEchConfigList)
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lookups != test.lookups {
+			t.Fatalf("%s: expected %d ECHConfigList lookups, got %d", test.name, test.lookups, lookups)
+		}
+	}
+}
+
+func TestEchConfigListCachedPerHostAndPort(t *testing.T) {
+	configList := []byte{0x00, 0x04, 0xfe, 0x0d, 0x00, 0x00}
+	server := startTestDnsServer(t, func(query *dnsmessage.Message, isTcp bool) *dnsmessage.Message {
+		name := query.Questions[0].Name
+		ttl := uint32(300)
+		if strings.HasPrefix(name.String(), "uncached.") {
+			ttl = 0
+		}
+		data := []byte{0x00, 0x01, 0x00, 0x00, svcParamKeyEch}
+		data = binary.BigEndian.AppendUint16(data, uint16(len(configList)))
+		data = append(data, configList...)
+		return &dnsmessage.Message{
+			Header: dnsmessage.Header{ID: query.ID},
+			Answers: []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: name, Type: dnsTypeHTTPS, Class: dnsmessage.ClassINET, TTL: ttl},
+				Body:   &dnsmessage.UnknownResource{Type: dnsTypeHTTPS, Data: data},
+			}},
+		}
+	})
+	setTestGlobal(t, &echResolver, newTestStubResolver(t, DnsResolverTcp, server.addr))
+	setTestGlobal(t, &echConfigCache, NewEchConfigCache(10))
+
+	lookup := func(host string, port string) {
+		t.Helper()
+		result, err := GetEchConfigList(ConnectArgs{Host: "127.0.0.1", Servername: host, Port: port})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(result, configList) {
+			t.Fatalf("expected the ech param, got %x", result)
+		}
+	}
+
+	lookup("ech.example.com", "443")
+	lookup("ech.example.com", "443")
+	if queries := server.queries.Load(); queries != 1 {
+		t.Fatalf("expected the second lookup to be cached, got %d queries", queries)
+	}
+	lookup("ech.example.com", "8443")
+	if queries := server.queries.Load(); queries != 2 {
+		t.Fatalf("expected another port to be looked up, got %d queries", queries)
+	}
+	lookup("uncached.example.com", "443")
+	lookup("uncached.example.com", "443")
+	if queries := server.queries.Load(); queries != 4 {
+		t.Fatalf("expected records with a zero ttl to not be cached, got %d queries", queries)
+	}
+}
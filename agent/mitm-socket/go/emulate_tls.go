@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/base64"
+	"fmt"
 	"io"
 	"net"
 	"os"
@@ -13,48 +14,30 @@ import (
 
 var isInited = false
 
-func EmulateTls(dialConn net.Conn, addr string, sessionArgs SessionArgs, connectArgs ConnectArgs) (*tls.UConn, error) {
+// EmulatedTls describes how the connection was established
+type EmulatedTls struct {
+	ClientHelloProfile string
+	// set if the server requested a client certificate and one was configured
+	ClientCertificate *UsedClientCertificate
+	KeyExchangeGroup  tls.CurveID
+}
+
+func EmulateTls(dialConn net.Conn, addr string, sessionArgs SessionArgs, connectArgs ConnectArgs, getEchConfigList func() []byte) (*tls.UConn, *EmulatedTls, error) {
 	if isInited == false {
 		tls.EnableWeakCiphers()
 		isInited = true
 	}
-	var err error
 
 	// Upgrade connection with correct TLS signature
-	var spec tls.ClientHelloSpec
-	if sessionArgs.ClientHelloId == "Safari13" {
-		spec = GetSafari13Spec()
-	} else if strings.HasPrefix(sessionArgs.ClientHelloId, "chrome-") {
-		chromeVersionBit := strings.Split(sessionArgs.ClientHelloId, "chrome-")[1]
-		chromeVersion, _ := strconv.ParseInt(chromeVersionBit, 10, 0)
-		// lowest supported is chrome 72, otherwise channel id extensions crop up
-		if chromeVersion < 83 {
-			spec, _ = tls.UTLSIdToSpec(tls.HelloChrome_72)
-		} else if chromeVersion < 91 {
-			// application settings added in chrome 91
-			spec, _ = tls.UTLSIdToSpec(tls.HelloChrome_83)
-		} else if chromeVersion < 98 {
-			// chrome 98 removed tls 1.1, 1.0
-			spec, _ = tls.UTLSIdToSpec(tls.HelloChrome_96)
-		} else if chromeVersion < 110 {
-			// chrome 110 implemented shuffling
-			spec, _ = tls.UTLSIdToSpec(tls.HelloChrome_100)
-		} else if chromeVersion < 119 {
-			spec, _ = tls.UTLSIdToSpec(tls.HelloChrome_106_Shuffle)
-		} else if chromeVersion < 124 {
-			spec, _ = tls.UTLSIdToSpec(tls.HelloChrome_120)
-		} else if chromeVersion < 131 {
-			spec, _ = tls.UTLSIdToSpec(tls.HelloChrome_120_PQ)
-		} else if chromeVersion < 133 {
-            // Chrome 131+ uses the latest available Chrome PQ spec
-            spec, _ = tls.UTLSIdToSpec(tls.HelloChrome_131)
-        } else {
-			// chrome 133 uses new alps extension
-			spec, _ = tls.UTLSIdToSpec(tls.HelloChrome_133)
-		}
-	} else {
-		// default to latest shuffle
-		spec, _ = tls.UTLSIdToSpec(tls.HelloChrome_106_Shuffle)
+	spec, clientHelloProfile, err := getClientHelloSpec(sessionArgs)
+	if err != nil {
+		return nil, nil, err
+	}
+	emulated := &EmulatedTls{ClientHelloProfile: clientHelloProfile}
+
+	clientCertificate, err := GetClientCertificate(connectArgs)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	tlsConfig := tls.Config{
@@ -62,11 +45,47 @@ func EmulateTls(dialConn net.Conn, addr string, sessionArgs SessionArgs, connect
 		InsecureSkipVerify: !sessionArgs.RejectUnauthorized,
 	}
 
+	if sessionArgs.RejectUnauthorized {
+		tlsConfig.RootCAs = rootCas
+		host := connectHost(connectArgs)
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			return verifySpkiPins(host, state)
+		}
+	}
+
+	if clientCertificate != nil {
+		// only sent if the server asks for it, so the ClientHello is unchanged
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			emulated.ClientCertificate = describeClientCertificate(clientCertificate)
+			return clientCertificate, nil
+		}
+	}
+
+	if tlsSessionCache != nil {
+		tlsConfig.ClientSessionCache = tlsSessionCache.ForSpec(&spec)
+		// psk is only sent when resuming a tls 1.3 session, and only by profiles that support psk resumption
+		tlsConfig.OmitEmptyPsk = true
+		tlsConfig.PreferSkipResumptionOnNilExtension = true
+		spec.Extensions = withPreSharedKeyExtension(spec.Extensions)
+	}
+
+	// real ECH is only possible if the emulated browser sends the extension. Otherwise it would be a new fingerprint,
+	// so the ECHConfigList isn't looked up either.
+	if hasEchExtension(&spec) {
+		if echConfigList := getEchConfigList(); echConfigList != nil {
+			tlsConfig.EncryptedClientHelloConfigList = echConfigList
+			if !sessionArgs.RejectUnauthorized {
+				// the public name certificate is otherwise verified even with InsecureSkipVerify
+				tlsConfig.EncryptedClientHelloRejectionVerify = func(tls.ConnectionState) error { return nil }
+			}
+		}
+	}
+
 	if connectArgs.KeylogPath != "" {
 		var keylog io.Writer
 		keylog, err = os.OpenFile(connectArgs.KeylogPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		tlsConfig.KeyLogWriter = keylog
 	}
@@ -81,7 +100,8 @@ func EmulateTls(dialConn net.Conn, addr string, sessionArgs SessionArgs, connect
 		}
 	}
 
-	tlsConn := tls.UClient(dialConn, &tlsConfig, tls.HelloCustom)
+	recorder := newHandshakeRecorder(dialConn)
+	tlsConn := tls.UClient(recorder, &tlsConfig, tls.HelloCustom)
 
 	if connectArgs.IsWebsocket {
 		tmp := spec.Extensions[:0]
@@ -95,15 +115,88 @@ func EmulateTls(dialConn net.Conn, addr string, sessionArgs SessionArgs, connect
 
 	err = tlsConn.ApplyPreset(&spec)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	err = tlsConn.Handshake()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	emulated.KeyExchangeGroup = recorder.Stop()
 
-	return tlsConn, nil
+	return tlsConn, emulated, nil
+}
+
+// getClientHelloSpec returns the spec to emulate and the name of the profile it came from
+func getClientHelloSpec(sessionArgs SessionArgs) (tls.ClientHelloSpec, string, error) {
+	if sessionArgs.ClientHelloSpec != nil {
+		spec, err := sessionArgs.ClientHelloSpec.ToSpec()
+		return spec, "custom", err
+	}
+	if sessionArgs.ClientHelloRaw != "" {
+		raw, err := ParseRawClientHello(sessionArgs.ClientHelloRaw)
+		if err != nil {
+			return tls.ClientHelloSpec{}, "", err
+		}
+		spec, err := raw.ToSpec()
+		return spec, "raw", err
+	}
+	if sessionArgs.ClientHelloProfile != "" {
+		profile, err := LoadClientHelloProfile(sessionArgs.ClientHelloProfile, sessionArgs.ClientHelloProfilesDir)
+		if err != nil {
+			return tls.ClientHelloSpec{}, "", err
+		}
+		spec, err := profile.ToSpec()
+		return spec, sessionArgs.ClientHelloProfile, err
+	}
+	if sessionArgs.ClientHelloId == "Safari13" {
+		spec, err := getClientHelloProfileSpec("safari13")
+		return spec, "safari13", err
+	}
+
+	clientHelloId := sessionArgs.ClientHelloId
+	// Chrome79 is a legacy id (agent tests) that always got the default
+	if clientHelloId == "" || clientHelloId == "Chrome79" {
+		// default to latest shuffle
+		spec, err := tls.UTLSIdToSpec(tls.HelloChrome_106_Shuffle)
+		return spec, "HelloChrome_106_Shuffle", err
+	}
+
+	browser, versionBit, _ := strings.Cut(clientHelloId, "-")
+	if _, ok := clientHelloVersions[browser]; !ok {
+		return tls.ClientHelloSpec{}, "", fmt.Errorf("Unsupported ClientHelloId %s", clientHelloId)
+	}
+	version, err := strconv.ParseInt(strings.Split(versionBit, ".")[0], 10, 0)
+	if err != nil || version < 0 {
+		return tls.ClientHelloSpec{}, "", fmt.Errorf("Invalid ClientHelloId %s. Expected <browser>-<version>, eg, chrome-133.", clientHelloId)
+	}
+	return FindClientHelloVersion(browser, version, sessionArgs.ClientHelloProfilesDir)
+}
+
+func getClientHelloProfileSpec(name string) (tls.ClientHelloSpec, error) {
+	profile, err := LoadClientHelloProfile(name, "")
+	if err != nil {
+		return tls.ClientHelloSpec{}, err
+	}
+	return profile.ToSpec()
+}
+
+// browsers that resume tls 1.3 sessions send psk_key_exchange_modes, and pre_shared_key last (RFC 8446 4.2.11).
+// Other profiles are left alone so resumption doesn't change their fingerprint.
+func withPreSharedKeyExtension(extensions []tls.TLSExtension) []tls.TLSExtension {
+	supportsPsk := false
+	for _, ext := range extensions {
+		switch ext.(type) {
+		case tls.PreSharedKeyExtension:
+			return extensions
+		case *tls.PSKKeyExchangeModesExtension:
+			supportsPsk = true
+		}
+	}
+	if !supportsPsk {
+		return extensions
+	}
+	return append(extensions, &tls.UtlsPreSharedKeyExtension{})
 }
 
 func removeIndex(s []string, index int) []string {
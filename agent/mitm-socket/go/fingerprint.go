@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// ClientHelloFingerprint describes the ClientHello that was actually sent to the remote server
+type ClientHelloFingerprint struct {
+	Ja3     string
+	Ja3Hash string
+	Ja4     string
+	Ja4r    string
+}
+
+type parsedClientHello struct {
+	legacyVersion       uint16
+	cipherSuites        []uint16
+	extensions          []uint16
+	supportedGroups     []uint16
+	pointFormats        []uint8
+	signatureAlgorithms []uint16
+	alpnProtocols       []string
+	supportedVersions   []uint16
+	hasServerName       bool
+}
+
+// FingerprintClientHello calculates JA3 and JA4 for a raw ClientHello handshake message (no record header)
+func FingerprintClientHello(raw []byte) (*ClientHelloFingerprint, error) {
+	hello, err := parseClientHello(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	ja3 := hello.ja3()
+	ja3Hash := md5.Sum([]byte(ja3))
+	ja4, ja4r := hello.ja4()
+
+	return &ClientHelloFingerprint{
+		Ja3:     ja3,
+		Ja3Hash: hex.EncodeToString(ja3Hash[:]),
+		Ja4:     ja4,
+		Ja4r:    ja4r,
+	}, nil
+}
+
+func hasClientHelloExtension(raw []byte, extension uint16) bool {
+	hello, err := parseClientHello(raw)
+	if err != nil {
+		return false
+	}
+	for _, id := range hello.extensions {
+		if id == extension {
+			return true
+		}
+	}
+	return false
+}
+
+func parseClientHello(raw []byte) (*parsedClientHello, error) {
+	hello := &parsedClientHello{}
+	s := cryptobyte.String(raw)
+
+	var messageType uint8
+	var body cryptobyte.String
+	if !s.ReadUint8(&messageType) || messageType != handshakeTypeClientHello || !s.ReadUint24LengthPrefixed(&body) {
+		return nil, errors.New("Not a ClientHello handshake message")
+	}
+
+	var sessionId, cipherSuites, compressionMethods cryptobyte.String
+	if !body.ReadUint16(&hello.legacyVersion) ||
+		!body.Skip(32) ||
+		!body.ReadUint8LengthPrefixed(&sessionId) ||
+		!body.ReadUint16LengthPrefixed(&cipherSuites) ||
+		!body.ReadUint8LengthPrefixed(&compressionMethods) {
+		return nil, errors.New("Malformed ClientHello")
+	}
+
+	for !cipherSuites.Empty() {
+		var cipher uint16
+		if !cipherSuites.ReadUint16(&cipher) {
+			return nil, errors.New("Malformed ClientHello cipher suites")
+		}
+		hello.cipherSuites = append(hello.cipherSuites, cipher)
+	}
+
+	if body.Empty() {
+		return hello, nil
+	}
+
+	var extensions cryptobyte.String
+	if !body.ReadUint16LengthPrefixed(&extensions) {
+		return nil, errors.New("Malformed ClientHello extensions")
+	}
+
+	for !extensions.Empty() {
+		var extension uint16
+		var data cryptobyte.String
+		if !extensions.ReadUint16(&extension) || !extensions.ReadUint16LengthPrefixed(&data) {
+			return nil, errors.New("Malformed ClientHello extension")
+		}
+		hello.extensions = append(hello.extensions, extension)
+
+		switch extension {
+		case extensionServerName:
+			hello.hasServerName = true
+		case extensionSupportedGroups:
+			var groups cryptobyte.String
+			if data.ReadUint16LengthPrefixed(&groups) {
+				hello.supportedGroups = readUint16List(groups)
+			}
+		case extensionPointFormats:
+			var formats cryptobyte.String
+			if data.ReadUint8LengthPrefixed(&formats) {
+				hello.pointFormats = []uint8(formats)
+			}
+		case extensionSignatureAlgorithms:
+			var algorithms cryptobyte.String
+			if data.ReadUint16LengthPrefixed(&algorithms) {
+				hello.signatureAlgorithms = readUint16List(algorithms)
+			}
+		case extensionALPN:
+			var protocols cryptobyte.String
+			if data.ReadUint16LengthPrefixed(&protocols) {
+				for !protocols.Empty() {
+					var protocol cryptobyte.String
+					if !protocols.ReadUint8LengthPrefixed(&protocol) {
+						break
+					}
+					hello.alpnProtocols = append(hello.alpnProtocols, string(protocol))
+				}
+			}
+		case extensionSupportedVersions:
+			var versions cryptobyte.String
+			if data.ReadUint8LengthPrefixed(&versions) {
+				hello.supportedVersions = readUint16List(versions)
+			}
+		}
+	}
+
+	return hello, nil
+}
+
+func readUint16List(s cryptobyte.String) []uint16 {
+	var values []uint16
+	var value uint16
+	for s.ReadUint16(&value) {
+		values = append(values, value)
+	}
+	return values
+}
+
+func withoutGrease(values []uint16) []uint16 {
+	filtered := make([]uint16, 0, len(values))
+	for _, value := range values {
+		if !isGreaseValue(value) {
+			filtered = append(filtered, value)
+		}
+	}
+	return filtered
+}
+
+func joinUint16(values []uint16, format string) string {
+	parts := make([]string, len(values))
+	for i, value := range values {
+		parts[i] = fmt.Sprintf(format, value)
+	}
+	return strings.Join(parts, ",")
+}
+
+// https://github.com/salesforce/ja3
+func (hello *parsedClientHello) ja3() string {
+	pointFormats := make([]string, len(hello.pointFormats))
+	for i, format := range hello.pointFormats {
+		pointFormats[i] = strconv.Itoa(int(format))
+	}
+
+	return strings.Join([]string{
+		strconv.Itoa(int(hello.legacyVersion)),
+		strings.ReplaceAll(joinUint16(withoutGrease(hello.cipherSuites), "%d"), ",", "-"),
+		strings.ReplaceAll(joinUint16(withoutGrease(hello.extensions), "%d"), ",", "-"),
+		strings.ReplaceAll(joinUint16(withoutGrease(hello.supportedGroups), "%d"), ",", "-"),
+		strings.Join(pointFormats, "-"),
+	}, ",")
+}
+
+// https://github.com/FoxIO-LLC/ja4/blob/main/technical_details/JA4.md
+func (hello *parsedClientHello) ja4() (string, string) {
+	version := hello.legacyVersion
+	if supportedVersions := withoutGrease(hello.supportedVersions); len(supportedVersions) > 0 {
+		version = supportedVersions[0]
+		for _, supported := range supportedVersions {
+			if supported > version {
+				version = supported
+			}
+		}
+	}
+
+	sni := "i"
+	if hello.hasServerName {
+		sni = "d"
+	}
+
+	ciphers := withoutGrease(hello.cipherSuites)
+	extensions := withoutGrease(hello.extensions)
+
+	ja4a := fmt.Sprintf("t%s%s%02d%02d%s", ja4Version(version), sni, min(len(ciphers), 99), min(len(extensions), 99), hello.ja4Alpn())
+
+	sortedCiphers := append([]uint16{}, ciphers...)
+	sort.Slice(sortedCiphers, func(i, j int) bool { return sortedCiphers[i] < sortedCiphers[j] })
+
+	// sni and alpn are already represented in the first section
+	sortedExtensions := make([]uint16, 0, len(extensions))
+	for _, extension := range extensions {
+		if extension != extensionServerName && extension != extensionALPN {
+			sortedExtensions = append(sortedExtensions, extension)
+		}
+	}
+	sort.Slice(sortedExtensions, func(i, j int) bool { return sortedExtensions[i] < sortedExtensions[j] })
+
+	ja4b := joinUint16(sortedCiphers, "%04x")
+	ja4c := joinUint16(sortedExtensions, "%04x")
+	if len(hello.signatureAlgorithms) > 0 {
+		ja4c += "_" + joinUint16(hello.signatureAlgorithms, "%04x")
+	}
+
+	ja4 := fmt.Sprintf("%s_%s_%s", ja4a, ja4Hash(ja4b, len(sortedCiphers) == 0), ja4Hash(ja4c, len(sortedExtensions) == 0))
+	ja4r := fmt.Sprintf("%s_%s_%s", ja4a, ja4b, ja4c)
+	return ja4, ja4r
+}
+
+func (hello *parsedClientHello) ja4Alpn() string {
+	if len(hello.alpnProtocols) == 0 || len(hello.alpnProtocols[0]) == 0 {
+		return "00"
+	}
+	alpn := hello.alpnProtocols[0]
+	first := alpn[0]
+	last := alpn[len(alpn)-1]
+	if isAlphanumeric(first) && isAlphanumeric(last) {
+		return string([]byte{first, last})
+	}
+	firstHex := hex.EncodeToString([]byte{first})
+	lastHex := hex.EncodeToString([]byte{last})
+	return firstHex[:1] + lastHex[1:]
+}
+
+func isAlphanumeric(char byte) bool {
+	return (char >= '0' && char <= '9') || (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z')
+}
+
+func ja4Version(version uint16) string {
+	switch version {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	}
+	return "00"
+}
+
+func ja4Hash(value string, isEmpty bool) string {
+	if isEmpty {
+		return "000000000000"
+	}
+	hash := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(hash[:])[:12]
+}
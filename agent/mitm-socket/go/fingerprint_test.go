@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// a chrome-like ClientHello with the cipher suites of the JA4 reference example
+func fingerprintTestSpec() *tls.ClientHelloSpec {
+	return &tls.ClientHelloSpec{
+		CipherSuites: []uint16{
+			tls.GREASE_PLACEHOLDER, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8, 0xc013,
+			0xc014, 0x009c, 0x009d, 0x002f, 0x0035,
+		},
+		CompressionMethods: []uint8{0},
+		Extensions: []tls.TLSExtension{
+			&tls.UtlsGREASEExtension{},
+			&tls.SNIExtension{},
+			&tls.ExtendedMasterSecretExtension{},
+			&tls.RenegotiationInfoExtension{Renegotiation: tls.RenegotiateOnceAsClient},
+			&tls.SupportedCurvesExtension{Curves: []tls.CurveID{tls.GREASE_PLACEHOLDER, tls.X25519, tls.CurveP256, tls.CurveP384}},
+			&tls.SupportedPointsExtension{SupportedPoints: []byte{0}},
+			&tls.SessionTicketExtension{},
+			&tls.ALPNExtension{AlpnProtocols: []string{"h2", "http/1.1"}},
+			&tls.StatusRequestExtension{},
+			&tls.SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: []tls.SignatureScheme{
+				0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601,
+			}},
+			&tls.SCTExtension{},
+			&tls.KeyShareExtension{KeyShares: []tls.KeyShare{{Group: tls.GREASE_PLACEHOLDER, Data: []byte{0}}, {Group: tls.X25519}}},
+			&tls.PSKKeyExchangeModesExtension{Modes: []uint8{tls.PskModeDHE}},
+			&tls.SupportedVersionsExtension{Versions: []uint16{tls.GREASE_PLACEHOLDER, tls.VersionTLS13, tls.VersionTLS12}},
+			&tls.UtlsCompressCertExtension{Algorithms: []tls.CertCompressionAlgo{tls.CertCompressionBrotli}},
+			&tls.UtlsGREASEExtension{},
+		},
+	}
+}
+
+func TestFingerprintClientHello(t *testing.T) {
+	fingerprint, err := FingerprintClientHello(buildClientHello(t, fingerprintTestSpec()).HandshakeState.Hello.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// GREASE values are left out, everything else is in the order it was sent
+	expectedJa3 := "771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53," +
+		"0-23-65281-10-11-35-16-5-13-18-51-45-43-27,29-23-24,0"
+	if fingerprint.Ja3 != expectedJa3 {
+		t.Fatalf("unexpected ja3\n%s\n%s", fingerprint.Ja3, expectedJa3)
+	}
+	if fingerprint.Ja3Hash != "7f805430de1e7d98b1de033adb58cf46" {
+		t.Fatalf("unexpected ja3 hash %s", fingerprint.Ja3Hash)
+	}
+
+	// ciphers and extensions are sorted. sni and alpn only count towards the number of extensions.
+	expectedJa4r := "t13d1514h2_002f,0035,009c,009d,1301,1302,1303,c013,c014,c02b,c02c,c02f,c030,cca8,cca9_" +
+		"0005,000a,000b,000d,0012,0017,001b,0023,002b,002d,0033,ff01_0403,0804,0401,0503,0805,0501,0806,0601"
+	if fingerprint.Ja4r != expectedJa4r {
+		t.Fatalf("unexpected ja4_r\n%s\n%s", fingerprint.Ja4r, expectedJa4r)
+	}
+	// the cipher hash matches the JA4 reference example (t13d1516h2_8daaf6152771_...)
+	if fingerprint.Ja4 != "t13d1514h2_8daaf6152771_bc9a4605e104" {
+		t.Fatalf("unexpected ja4 %s", fingerprint.Ja4)
+	}
+
+	// shuffled GREASE values and key shares don't change the fingerprint
+	again, err := FingerprintClientHello(buildClientHello(t, fingerprintTestSpec()).HandshakeState.Hello.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *again != *fingerprint {
+		t.Fatalf("expected the same fingerprint, got %+v", again)
+	}
+}
+
+func TestFingerprintWithoutSniOrAlpn(t *testing.T) {
+	spec := &tls.ClientHelloSpec{
+		TLSVersMin:         tls.VersionTLS12,
+		TLSVersMax:         tls.VersionTLS12,
+		CipherSuites:       []uint16{0xc02f},
+		CompressionMethods: []uint8{0},
+		Extensions: []tls.TLSExtension{
+			&tls.SupportedCurvesExtension{Curves: []tls.CurveID{tls.CurveP256}},
+			&tls.SupportedPointsExtension{SupportedPoints: []byte{0}},
+		},
+	}
+	fingerprint, err := FingerprintClientHello(buildClientHello(t, spec).HandshakeState.Hello.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fingerprint.Ja4r != "t12i010200_c02f_000a,000b" {
+		t.Fatalf("unexpected ja4_r %s", fingerprint.Ja4r)
+	}
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"crypto"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/sha1"
 	"crypto/x509"
 	"crypto/x509/pkix"
@@ -14,21 +13,25 @@ import (
 	"math/big"
 	"net"
 	"os"
-	"sync/atomic"
+	"path/filepath"
+	"sync"
 	"time"
 )
 
 /// Reference/Credit: https://github.com/AdguardTeam/gomitmproxy
 
-// While generating a new certificate, in order to get a unique serial
-// number every time we increment this value.
-var currentSerialNumber int64 = time.Now().Unix()
+// serial numbers are random so they don't repeat across restarts (revocation and the cert cache key by serial)
+var maxSerialNumber = new(big.Int).Lsh(big.NewInt(1), 128)
+
+func newSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, maxSerialNumber)
+}
 
 // Config is a set of configuration values that are used to build TLS configs
 // capable of MITM.
 type CertConfig struct {
 	ca           *x509.Certificate // Root certificate authority
-	caPrivateKey *rsa.PrivateKey   // CA private key
+	caPrivateKey crypto.Signer     // CA private key
 
 	// privateKey is the private key that will be used to generate leaf certificates
 	publicKey     crypto.PublicKey
@@ -36,6 +39,30 @@ type CertConfig struct {
 
 	keyID        []byte // SKI to use in generated certificates (https://tools.ietf.org/html/rfc3280#section-4.2.1.2)
 	organization string // Organization (will be used for generated certificates)
+
+	// leaf keys by key type for mirrored upstream certificates. Generated on first use.
+	mirrorKeysMutex sync.Mutex
+	mirrorKeys      map[string]*mirrorKey
+
+	// guards ca, caPrivateKey and the rotation fields below
+	caMutex sync.RWMutex
+	// CAs generated by us are rotated before they expire (see CheckAuthorityExpiry)
+	isGeneratedCa   bool
+	storageDir      string
+	caKeyType       string
+	nameConstraints *CaNameConstraints
+	// after a rotation, leaf chains include the new CA cross-signed by the previous one until the previous expires
+	previousCa     *x509.Certificate
+	caCrossCertPEM []byte
+
+	// base url of the RevocationServer. Embedded as OCSP, CRL and CA issuer urls in leaf certificates.
+	revocationUrl string
+}
+
+type mirrorKey struct {
+	privateKey    crypto.Signer
+	privateKeyPEM string
+	keyID         []byte
 }
 
 func readCertFromDisk(file string) (*x509.Certificate, error) {
@@ -53,74 +80,127 @@ func readCertFromDisk(file string) (*x509.Certificate, error) {
 	return cert, nil
 }
 
-func readPrivateKeyFromDisk(file string) (*rsa.PrivateKey, error) {
+// readPrivateKeyFromDisk reads a PKCS#8 key. If keyType is set, keys of another type are rejected.
+func readPrivateKeyFromDisk(file string, keyType string) (crypto.Signer, error) {
 
 	bytes, err := os.ReadFile(file)
 	if err != nil {
 		return nil, err
 	}
 
-	key, err := x509.ParsePKCS8PrivateKey(bytes)
+	key, err := parsePrivateKey(bytes)
 	if err != nil {
 		return nil, err
 	}
 
-	privatePkcs8RsaKey, ok := key.(*rsa.PrivateKey)
-	if !ok {
-		return nil, fmt.Errorf("Pkcs8 contained non-RSA key. Expected RSA key.")
+	if keyType != "" {
+		diskKeyType, err := keyTypeOf(key.Public())
+		if err != nil {
+			return nil, err
+		}
+		if diskKeyType != keyType {
+			return nil, fmt.Errorf("Key is %s. Expected %s.", diskKeyType, keyType)
+		}
 	}
-	return privatePkcs8RsaKey, nil
+	return key, nil
 }
 
-// NewAuthority creates a new CA certificate and associated private key.
-func NewAuthority() (*x509.Certificate, *rsa.PrivateKey, error) {
-	var caFile string = "ca.der"
-	var caKeyFile string = "caKey.der"
+// NewAuthority creates a new CA certificate and associated private key in storageDir (or reads them from there).
+// A CA on disk with a different key type than keyType or different name constraints is replaced. An empty keyType
+// accepts any existing CA.
+func NewAuthority(storageDir string, keyType string, nameConstraints *CaNameConstraints) (*x509.Certificate, crypto.Signer, error) {
+	var caFile string = filepath.Join(storageDir, "ca.der")
+	var caKeyFile string = filepath.Join(storageDir, "caKey.der")
 
 	certFromDisk, err := readCertFromDisk(caFile)
 
 	if err != nil && !errors.Is(err, os.ErrNotExist) {
 		log.Print("Error reading cert from disk", caFile, err)
 	} else if err == nil {
-		keyFromDisk, err := readPrivateKeyFromDisk(caKeyFile)
+		keyFromDisk, err := readPrivateKeyFromDisk(caKeyFile, keyType)
 		if err != nil {
 			log.Print("Error reading private key from disk", caKeyFile, err)
+		} else if !nameConstraints.MatchesAuthority(certFromDisk) {
+			log.Print("Replacing CA with different name constraints", caFile)
 		} else {
 			return certFromDisk, keyFromDisk, nil
 		}
 	}
 
-	// Generating the private key that will be used for domain certificates
-	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	return createAuthority(storageDir, keyType, nameConstraints)
+}
+
+// createAuthority generates a CA and writes it to storageDir
+func createAuthority(storageDir string, keyType string, nameConstraints *CaNameConstraints) (*x509.Certificate, crypto.Signer, error) {
+	var caFile string = filepath.Join(storageDir, "ca.der")
+	var caKeyFile string = filepath.Join(storageDir, "caKey.der")
+
+	if keyType == "" {
+		keyType = KeyTypeRsa2048
+	}
+	priv, err := generateKey(keyType)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	raw, err := createAuthorityCertificate(priv, nameConstraints)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = os.WriteFile(caFile, raw, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	privBytes, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = os.WriteFile(caKeyFile, privBytes, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Parse certificate bytes so that we have a leaf certificate.
+	x509c, err := x509.ParseCertificate(raw)
 	if err != nil {
 		return nil, nil, err
 	}
+
+	return x509c, priv, nil
+}
+
+// createAuthorityCertificate self-signs a CA certificate for priv (which can be backed by an HSM)
+func createAuthorityCertificate(priv crypto.Signer, nameConstraints *CaNameConstraints) ([]byte, error) {
 	pub := priv.Public()
 
 	// Subject Key Identifier support for end entity certificate.
 	// https://tools.ietf.org/html/rfc3280#section-4.2.1.2
 	pkixpub, err := x509.MarshalPKIXPublicKey(pub)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 	h := sha1.New()
 	_, err = h.Write(pkixpub)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 	keyID := h.Sum(nil)
 
-	// Increment the serial number
-	serial := atomic.AddInt64(&currentSerialNumber, 1)
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
 
 	tmpl := &x509.Certificate{
-		SerialNumber: big.NewInt(serial),
+		SerialNumber: serial,
 		Subject: pkix.Name{
 			CommonName:   "Unblocked",
 			Organization: []string{"Unblocked"},
 		},
 		SubjectKeyId:          keyID,
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		KeyUsage:              keyUsageFor(pub) | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
 		NotBefore:             time.Now().AddDate(-1, 0, 0),
@@ -128,55 +208,42 @@ func NewAuthority() (*x509.Certificate, *rsa.PrivateKey, error) {
 		DNSNames:              []string{"Unblocked"},
 		IsCA:                  true,
 	}
-
-	raw, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, priv)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	err = os.WriteFile(caFile, raw, 0600)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	privBytes, err := x509.MarshalPKCS8PrivateKey(priv)
-	if err != nil {
-		return nil, nil, err
-	}
-	err = os.WriteFile(caKeyFile, privBytes, 0600)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	// Parse certificate bytes so that we have a leaf certificate.
-	x509c, err := x509.ParseCertificate(raw)
+	err = nameConstraints.Apply(tmpl)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	return x509c, priv, nil
+	return x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, priv)
 }
 
-func NewCertConfig(ca *x509.Certificate, caPrivateKey *rsa.PrivateKey) (*CertConfig, error) {
+// NewCertConfig uses the given CA, or the CA in storageDir (created if missing). An empty storageDir is the
+// working directory. Key types default to rsa-2048. Name constraints only apply to a generated CA.
+func NewCertConfig(storageDir string, ca *x509.Certificate, caPrivateKey crypto.Signer, caKeyType string, leafKeyType string, caNameConstraints *CaNameConstraints) (*CertConfig, error) {
 
-	var priv *rsa.PrivateKey
+	var privKeyFile string = filepath.Join(storageDir, "privKey.der")
 
-	if ca == nil {
+	var priv crypto.Signer
+
+	isGeneratedCa := ca == nil
+	if isGeneratedCa {
 		var err error
-		ca, caPrivateKey, err = NewAuthority()
+		ca, caPrivateKey, err = NewAuthority(storageDir, caKeyType, caNameConstraints)
 
 		if err != nil {
 			return nil, err
 		}
 
-		priv, _ = readPrivateKeyFromDisk("privKey.der")
+		priv, _ = readPrivateKeyFromDisk(privKeyFile, leafKeyType)
 	}
 
 	var needsSave bool = false
 	if priv == nil {
+		if leafKeyType == "" {
+			leafKeyType = KeyTypeRsa2048
+		}
 		var err error
 		// Generating the private key that will be used for domain certificates
-		priv, err = rsa.GenerateKey(rand.Reader, 2048)
+		priv, err = generateKey(leafKeyType)
 		if err != nil {
 			return nil, err
 		}
@@ -188,7 +255,7 @@ func NewCertConfig(ca *x509.Certificate, caPrivateKey *rsa.PrivateKey) (*CertCon
 	}
 
 	if needsSave {
-		err = os.WriteFile("privKey.der", privBytes, 0600)
+		err = os.WriteFile(privKeyFile, privBytes, 0600)
 		if err != nil {
 			return nil, err
 		}
@@ -208,32 +275,48 @@ func NewCertConfig(ca *x509.Certificate, caPrivateKey *rsa.PrivateKey) (*CertCon
 	}
 	keyID := h.Sum(nil)
 
-	privateKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: privBytes})
-
-	return &CertConfig{
-		ca:            ca,
-		caPrivateKey:  caPrivateKey,
-		publicKey:     pub,
-		privateKeyPEM: string(privateKeyPEM),
-		keyID:         keyID,
-		organization:  "Unblocked",
-	}, nil
+	privateKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privBytes})
+
+	config := &CertConfig{
+		ca:              ca,
+		caPrivateKey:    caPrivateKey,
+		publicKey:       pub,
+		privateKeyPEM:   string(privateKeyPEM),
+		keyID:           keyID,
+		organization:    "Unblocked",
+		mirrorKeys:      make(map[string]*mirrorKey),
+		isGeneratedCa:   isGeneratedCa,
+		storageDir:      storageDir,
+		caKeyType:       caKeyType,
+		nameConstraints: caNameConstraints,
+	}
+	if isGeneratedCa {
+		config.loadCrossCert()
+	}
+	return config, nil
 }
 
 func (c *CertConfig) CreateCert(hostname string) ([]byte, int64, error) {
+	ca, caPrivateKey, chainPEM := c.authority()
 
-	// Increment the serial number
-	serial := atomic.AddInt64(&currentSerialNumber, 1)
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, 0, err
+	}
 	expireDate := time.Now().AddDate(0, 1, 0)
+	// a leaf outliving its CA fails validation
+	if expireDate.After(ca.NotAfter) {
+		expireDate = ca.NotAfter
+	}
 
 	tmpl := &x509.Certificate{
-		SerialNumber: big.NewInt(serial),
+		SerialNumber: serial,
 		Subject: pkix.Name{
 			CommonName:   hostname,
 			Organization: []string{c.organization},
 		},
 		SubjectKeyId:          c.keyID,
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		KeyUsage:              keyUsageFor(c.publicKey),
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
 		NotBefore:             time.Now().AddDate(0, 0, -1),
@@ -246,12 +329,137 @@ func (c *CertConfig) CreateCert(hostname string) ([]byte, int64, error) {
 		tmpl.DNSNames = []string{hostname}
 	}
 
-	derBytes, err := x509.CreateCertificate(rand.Reader, tmpl, c.ca, c.publicKey, c.caPrivateKey)
+	c.addRevocationUrls(tmpl, ca)
+
+	err = checkNameConstraints(ca, tmpl.DNSNames, tmpl.IPAddresses)
 	if err != nil {
 		return nil, 0, err
 	}
 
+	derBytes, err := x509.CreateCertificate(rand.Reader, tmpl, ca, c.publicKey, caPrivateKey)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+
+	return append(certPEM, chainPEM...), expireDate.Unix(), nil
+}
+
+// MirrorCert creates a certificate that copies the subject, alternative names, validity window, key type and
+// extended key usages of an upstream leaf certificate, signed by our CA. Returns the certificate, the PEM of its
+// private key and the expiration date. The hostname is added to upstream certificates with only a common name,
+// which browsers don't accept.
+func (c *CertConfig) MirrorCert(hostname string, upstreamPEM string) ([]byte, string, int64, error) {
+	block, _ := pem.Decode([]byte(upstreamPEM))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, "", 0, errors.New("Upstream certificate is not a PEM encoded certificate")
+	}
+	upstream, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	keyType, err := keyTypeOf(upstream.PublicKey)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	key, err := c.getMirrorKey(keyType)
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	ca, caPrivateKey, chainPEM := c.authority()
+
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, "", 0, err
+	}
+	expireDate := upstream.NotAfter
+	// a leaf outliving its CA fails validation
+	if expireDate.After(ca.NotAfter) {
+		expireDate = ca.NotAfter
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		RawSubject:            upstream.RawSubject,
+		SubjectKeyId:          key.keyID,
+		KeyUsage:              upstream.KeyUsage,
+		ExtKeyUsage:           upstream.ExtKeyUsage,
+		UnknownExtKeyUsage:    upstream.UnknownExtKeyUsage,
+		BasicConstraintsValid: true,
+		NotBefore:             upstream.NotBefore,
+		NotAfter:              expireDate,
+		DNSNames:              upstream.DNSNames,
+		IPAddresses:           upstream.IPAddresses,
+		EmailAddresses:        upstream.EmailAddresses,
+		URIs:                  upstream.URIs,
+	}
+	if len(tmpl.DNSNames) == 0 && len(tmpl.IPAddresses) == 0 && hostname != "" {
+		if ip := net.ParseIP(hostname); ip != nil {
+			tmpl.IPAddresses = []net.IP{ip}
+		} else {
+			tmpl.DNSNames = []string{hostname}
+		}
+	}
+	c.addRevocationUrls(tmpl, ca)
+
+	err = checkNameConstraints(ca, tmpl.DNSNames, tmpl.IPAddresses)
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, tmpl, ca, key.privateKey.Public(), caPrivateKey)
+	if err != nil {
+		return nil, "", 0, err
+	}
+
 	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
 
-	return certPEM, expireDate.Unix(), nil
+	return append(certPEM, chainPEM...), key.privateKeyPEM, expireDate.Unix(), nil
+}
+
+// addRevocationUrls embeds the RevocationServer urls. The crl url is only added if the CA can sign crls (CAs
+// created before crl support, and imported ones, may not have the key usage).
+func (c *CertConfig) addRevocationUrls(tmpl *x509.Certificate, ca *x509.Certificate) {
+	if c.revocationUrl == "" {
+		return
+	}
+	tmpl.OCSPServer = []string{c.revocationUrl + "/ocsp"}
+	tmpl.IssuingCertificateURL = []string{c.revocationUrl + "/ca"}
+	if ca.KeyUsage&x509.KeyUsageCRLSign != 0 {
+		tmpl.CRLDistributionPoints = []string{c.revocationUrl + "/crl"}
+	}
+}
+
+func (c *CertConfig) getMirrorKey(keyType string) (*mirrorKey, error) {
+	c.mirrorKeysMutex.Lock()
+	defer c.mirrorKeysMutex.Unlock()
+
+	if key, ok := c.mirrorKeys[keyType]; ok {
+		return key, nil
+	}
+
+	priv, err := generateKey(keyType)
+	if err != nil {
+		return nil, err
+	}
+	privBytes, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	pkixpub, err := x509.MarshalPKIXPublicKey(priv.Public())
+	if err != nil {
+		return nil, err
+	}
+	keyID := sha1.Sum(pkixpub)
+
+	key := &mirrorKey{
+		privateKey:    priv,
+		privateKeyPEM: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privBytes})),
+		keyID:         keyID[:],
+	}
+	c.mirrorKeys[keyType] = key
+	return key, nil
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestMirrorCertClampsToCaAndAddsHostname(t *testing.T) {
+	config := newTestCertConfig(t, nil)
+
+	upstreamKey, err := generateKey(KeyTypeEcdsaP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a common name only certificate that outlives our CA
+	upstream := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "legacy.example.com"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     config.ca.NotAfter.AddDate(5, 0, 0),
+	}
+	upstreamPEM := selfSignedPEM(t, upstream, upstreamKey)
+
+	setTestGlobal(t, &certCache, NewCertCache(10))
+
+	mirrored, err := config.CachedMirrorCert("legacy.example.com", upstreamPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mirrored.ExpireDate != config.ca.NotAfter.Unix() {
+		t.Fatalf("expected the expire date to be clamped to the CA, got %s", time.Unix(mirrored.ExpireDate, 0))
+	}
+	leaf := parseLeaf(t, mirrored.Cert)
+	if !leaf.NotAfter.Equal(config.ca.NotAfter) {
+		t.Fatalf("expected the leaf to expire with the CA, got %s", leaf.NotAfter)
+	}
+	if len(leaf.DNSNames) != 1 || leaf.DNSNames[0] != "legacy.example.com" || leaf.Subject.CommonName != "legacy.example.com" {
+		t.Fatalf("expected the hostname as a SAN, got %v", leaf.DNSNames)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(config.ca)
+	if _, err = leaf.Verify(x509.VerifyOptions{Roots: roots, DNSName: "legacy.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cached, err := config.CachedMirrorCert("legacy.example.com", upstreamPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached != mirrored {
+		t.Fatal("expected the mirrored certificate to be cached")
+	}
+}
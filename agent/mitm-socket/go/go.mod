@@ -6,14 +6,16 @@ toolchain go1.24.2
 
 require (
 	github.com/Microsoft/go-winio v0.6.2
+	github.com/miekg/pkcs11 v1.1.1
 	github.com/refraction-networking/utls v1.8.0
+	golang.org/x/crypto v0.37.0
 	golang.org/x/net v0.38.0
+	software.sslmate.com/src/go-pkcs12 v0.5.0
 )
 
 require (
 	github.com/andybalholm/brotli v1.1.1 // indirect
 	github.com/klauspost/compress v1.18.0 // indirect
-	golang.org/x/crypto v0.37.0 // indirect
 	golang.org/x/sys v0.32.0 // indirect
 	golang.org/x/text v0.24.0 // indirect
 )
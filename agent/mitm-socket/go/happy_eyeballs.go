@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	IpFamilyV4 = "ipv4"
+	IpFamilyV6 = "ipv6"
+)
+
+// RFC 8305 recommended delays
+const (
+	defaultConnectionAttemptDelay = 250 * time.Millisecond
+	resolutionDelay               = 50 * time.Millisecond
+)
+
+// DialInfo describes how a connection was established
+type DialInfo struct {
+	IpFamily string
+	// ip the hostname resolved to that was connected to. Empty for ip address hosts.
+	DnsResolvedIp string
+	// attempts that failed or were canceled because another address connected first
+	LosingAttempts []DialAttempt
+}
+
+type DialAttempt struct {
+	Address    string
+	Error      string
+	DurationMs int64
+}
+
+type lookupResult struct {
+	family string
+	ips    []net.IP
+	err    error
+}
+
+type attemptResult struct {
+	id   int
+	conn net.Conn
+	err  error
+}
+
+type dialingAttempt struct {
+	address string
+	start   time.Time
+	cancel  context.CancelFunc
+}
+
+// DialHappyEyeballs resolves ipv6 and ipv4 addresses in parallel and races connections to them (RFC 8305). Attempts
+// alternate address families starting with the preferred one, and a new attempt starts when the previous one fails
+// or after the connection attempt delay.
+func DialHappyEyeballs(dialer net.Dialer, addr string, sessionArgs SessionArgs) (net.Conn, *DialInfo, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	isIpHost := net.ParseIP(host) != nil
+	host, port, err = mapHost(hostResolverRules, host, port)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	families, preferredFamily, err := dialFamilies(sessionArgs)
+	if err != nil {
+		return nil, nil, err
+	}
+	// a local address can only connect to its own family
+	if localAddr, ok := dialer.LocalAddr.(*net.TCPAddr); ok {
+		family := ipFamily(localAddr.IP)
+		if !contains(families, family) {
+			return nil, nil, fmt.Errorf("SOCKET_BIND_ERR LocalAddress %s can't connect with IpFamily %s", localAddr.IP, sessionArgs.IpFamily)
+		}
+		families, preferredFamily = []string{family}, family
+	}
+	attemptDelay := defaultConnectionAttemptDelay
+	if sessionArgs.HappyEyeballsAttemptDelayMs > 0 {
+		attemptDelay = time.Duration(sessionArgs.HappyEyeballsAttemptDelayMs) * time.Millisecond
+	}
+
+	ctx := context.Background()
+	if dialer.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dialer.Timeout)
+		defer cancel()
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		family := ipFamily(ip)
+		if !contains(families, family) {
+			return nil, nil, fmt.Errorf("%s is not an allowed address family (%s)", host, family)
+		}
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+		if err != nil {
+			return nil, nil, err
+		}
+		info := &DialInfo{IpFamily: family}
+		// a hostname mapped to an ip by a host resolver rule
+		if !isIpHost {
+			info.DnsResolvedIp = ip.String()
+		}
+		return conn, info, nil
+	}
+
+	lookups := make(chan lookupResult, len(families))
+	for _, family := range families {
+		go func(family string) {
+			network := "ip4"
+			if family == IpFamilyV6 {
+				network = "ip6"
+			}
+			ips, err := dnsResolver.LookupIP(ctx, network, host)
+			lookups <- lookupResult{family: family, ips: ips, err: err}
+		}(family)
+	}
+
+	info := &DialInfo{}
+	queues := make(map[string][]net.IP)
+	pendingLookups := len(families)
+	// connection errors are more useful than a lookup error of the other family
+	var lookupErr, dialErr error
+	// attempts wait for the preferred family, or the resolution delay after the other family answered
+	isResolved := false
+	var resolutionTimer <-chan time.Time
+
+	results := make(chan attemptResult)
+	dialing := make(map[int]*dialingAttempt)
+	nextId := 0
+	lastFamily := ""
+	canStartAttempt := true
+	var attemptTimer <-chan time.Time
+
+	startAttempt := func() bool {
+		family := nextDialFamily(queues, lastFamily, preferredFamily)
+		if family == "" {
+			return false
+		}
+		ip := queues[family][0]
+		queues[family] = queues[family][1:]
+		lastFamily = family
+
+		attemptCtx, cancel := context.WithCancel(ctx)
+		id := nextId
+		nextId++
+		address := net.JoinHostPort(ip.String(), port)
+		dialing[id] = &dialingAttempt{address: address, start: time.Now(), cancel: cancel}
+		go func() {
+			conn, err := dialer.DialContext(attemptCtx, "tcp", address)
+			results <- attemptResult{id: id, conn: conn, err: err}
+		}()
+		return true
+	}
+
+	for {
+		if isResolved && canStartAttempt && startAttempt() {
+			canStartAttempt = false
+			attemptTimer = time.After(attemptDelay)
+		}
+		if isResolved && len(dialing) == 0 && pendingLookups == 0 && nextDialFamily(queues, lastFamily, preferredFamily) == "" {
+			if dialErr != nil {
+				return nil, info, dialErr
+			}
+			if lookupErr == nil {
+				lookupErr = fmt.Errorf("No addresses found for %s", host)
+			}
+			return nil, info, lookupErr
+		}
+
+		select {
+		case lookup := <-lookups:
+			pendingLookups--
+			if lookup.err != nil {
+				if lookupErr == nil {
+					lookupErr = lookup.err
+				}
+			} else {
+				queues[lookup.family] = append(queues[lookup.family], lookup.ips...)
+			}
+			if lookup.family == preferredFamily || pendingLookups == 0 {
+				isResolved = true
+			} else if len(lookup.ips) > 0 && resolutionTimer == nil {
+				resolutionTimer = time.After(resolutionDelay)
+			}
+
+		case <-resolutionTimer:
+			isResolved = true
+
+		case <-attemptTimer:
+			canStartAttempt = true
+
+		case result := <-results:
+			attempt := dialing[result.id]
+			delete(dialing, result.id)
+			attempt.cancel()
+			if result.err != nil {
+				if dialErr == nil {
+					dialErr = result.err
+				}
+				info.LosingAttempts = append(info.LosingAttempts, attempt.toDialAttempt(result.err))
+				// start the next attempt right away
+				canStartAttempt = true
+				continue
+			}
+
+			for _, loser := range dialing {
+				loser.cancel()
+				info.LosingAttempts = append(info.LosingAttempts, loser.toDialAttempt(context.Canceled))
+			}
+			go closeLateConnections(results, len(dialing))
+
+			remoteIp := result.conn.RemoteAddr().(*net.TCPAddr).IP
+			info.IpFamily = ipFamily(remoteIp)
+			info.DnsResolvedIp = remoteIp.String()
+			return result.conn, info, nil
+
+		case <-ctx.Done():
+			for _, attempt := range dialing {
+				attempt.cancel()
+			}
+			go closeLateConnections(results, len(dialing))
+			return nil, info, fmt.Errorf("dial tcp %s: %w", addr, ctx.Err())
+		}
+	}
+}
+
+// closeLateConnections waits for canceled attempts and closes connections that completed anyway
+func closeLateConnections(results chan attemptResult, remaining int) {
+	for i := 0; i < remaining; i++ {
+		if late := <-results; late.conn != nil {
+			late.conn.Close()
+		}
+	}
+}
+
+// dialFamilies returns the address families to use (SessionArgs.IpFamily) and the preferred one
+func dialFamilies(sessionArgs SessionArgs) ([]string, string, error) {
+	switch sessionArgs.IpFamily {
+	case IpFamilyV4:
+		return []string{IpFamilyV4}, IpFamilyV4, nil
+	case IpFamilyV6:
+		return []string{IpFamilyV6}, IpFamilyV6, nil
+	case "":
+	default:
+		return nil, "", fmt.Errorf("Unsupported IpFamily %s", sessionArgs.IpFamily)
+	}
+
+	switch sessionArgs.PreferredIpFamily {
+	case IpFamilyV4:
+		return []string{IpFamilyV4, IpFamilyV6}, IpFamilyV4, nil
+	case IpFamilyV6, "":
+		return []string{IpFamilyV6, IpFamilyV4}, IpFamilyV6, nil
+	}
+	return nil, "", fmt.Errorf("Unsupported PreferredIpFamily %s", sessionArgs.PreferredIpFamily)
+}
+
+// nextDialFamily alternates families (RFC 8305 section 4, First Address Family Count of 1)
+func nextDialFamily(queues map[string][]net.IP, lastFamily string, preferredFamily string) string {
+	otherFamily := IpFamilyV4
+	if preferredFamily == IpFamilyV4 {
+		otherFamily = IpFamilyV6
+	}
+	order := []string{preferredFamily, otherFamily}
+	if lastFamily == preferredFamily {
+		order = []string{otherFamily, preferredFamily}
+	}
+	for _, family := range order {
+		if len(queues[family]) > 0 {
+			return family
+		}
+	}
+	return ""
+}
+
+func ipFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return IpFamilyV4
+	}
+	return IpFamilyV6
+}
+
+func (attempt *dialingAttempt) toDialAttempt(err error) DialAttempt {
+	message := err.Error()
+	if errors.Is(err, context.Canceled) {
+		message = "canceled"
+	}
+	return DialAttempt{
+		Address:    attempt.address,
+		Error:      message,
+		DurationMs: time.Since(attempt.start).Milliseconds(),
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// dualStackResolver resolves every host to an ipv6 documentation address and ipv4 loopback
+func dualStackResolver() *testResolver {
+	return &testResolver{answer: func(network string, host string) ([]net.IP, error) {
+		if network == "ip6" {
+			return []net.IP{net.ParseIP("2001:db8::1")}, nil
+		}
+		return []net.IP{net.ParseIP("127.0.0.1")}, nil
+	}}
+}
+
+func TestHappyEyeballsFallsBackToIpv4(t *testing.T) {
+	setTestGlobal[Resolver](t, &dnsResolver, dualStackResolver())
+	_, port, _ := net.SplitHostPort(listenTest(t, func(conn net.Conn) { conn.Write([]byte("v4")) }))
+	dialer := net.Dialer{
+		Timeout: 5 * time.Second,
+		ControlContext: func(ctx context.Context, network string, address string, c syscall.RawConn) error {
+			if network == "tcp6" {
+				return errors.New("network is unreachable")
+			}
+			return nil
+		},
+	}
+
+	start := time.Now()
+	conn, info, err := DialHappyEyeballs(dialer, net.JoinHostPort("dual.example.com", port), SessionArgs{HappyEyeballsAttemptDelayMs: 5000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// a failed attempt starts the next one without waiting for the attempt delay
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("expected the ipv4 attempt to start when ipv6 failed, took %s", elapsed)
+	}
+	if info.IpFamily != IpFamilyV4 || info.DnsResolvedIp != "127.0.0.1" {
+		t.Fatalf("expected an ipv4 connection, got %+v", info)
+	}
+	if len(info.LosingAttempts) != 1 || info.LosingAttempts[0].Address != net.JoinHostPort("2001:db8::1", port) {
+		t.Fatalf("expected the failed ipv6 attempt, got %+v", info.LosingAttempts)
+	}
+	greeting := make([]byte, 2)
+	if _, err = io.ReadFull(conn, greeting); err != nil || string(greeting) != "v4" {
+		t.Fatalf("expected the ipv4 server, got %q %v", greeting, err)
+	}
+}
+
+func TestHappyEyeballsRacesHangingIpv6(t *testing.T) {
+	if listener, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skip("ipv6 sockets are not supported")
+	} else {
+		listener.Close()
+	}
+	setTestGlobal[Resolver](t, &dnsResolver, dualStackResolver())
+	_, port, _ := net.SplitHostPort(listenTest(t, func(conn net.Conn) {}))
+	dialer := net.Dialer{
+		Timeout: 5 * time.Second,
+		// ipv6 connects never complete
+		ControlContext: func(ctx context.Context, network string, address string, c syscall.RawConn) error {
+			if network == "tcp6" {
+				<-ctx.Done()
+				return ctx.Err()
+			}
+			return nil
+		},
+	}
+
+	start := time.Now()
+	conn, info, err := DialHappyEyeballs(dialer, net.JoinHostPort("dual.example.com", port), SessionArgs{HappyEyeballsAttemptDelayMs: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("expected ipv4 to wait for the attempt delay, took %s", elapsed)
+	}
+	if info.IpFamily != IpFamilyV4 {
+		t.Fatalf("expected ipv4 to win the race, got %+v", info)
+	}
+	if len(info.LosingAttempts) != 1 || info.LosingAttempts[0].Error != "canceled" {
+		t.Fatalf("expected the ipv6 attempt to be canceled, got %+v", info.LosingAttempts)
+	}
+}
+
+func TestHappyEyeballsIpFamily(t *testing.T) {
+	resolver := dualStackResolver()
+	setTestGlobal[Resolver](t, &dnsResolver, resolver)
+	_, port, _ := net.SplitHostPort(listenTest(t, func(conn net.Conn) {}))
+	dialer := net.Dialer{Timeout: 5 * time.Second}
+
+	conn, info, err := DialHappyEyeballs(dialer, net.JoinHostPort("dual.example.com", port), SessionArgs{IpFamily: IpFamilyV4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if info.IpFamily != IpFamilyV4 || len(info.LosingAttempts) != 0 || resolver.lookups.Load() != 1 {
+		t.Fatalf("expected only an ipv4 lookup and connection, got %+v", info)
+	}
+
+	_, _, err = DialHappyEyeballs(dialer, net.JoinHostPort("127.0.0.1", port), SessionArgs{IpFamily: IpFamilyV6})
+	if err == nil || !strings.Contains(err.Error(), "not an allowed address family") {
+		t.Fatalf("expected an ipv4 host to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	stdtls "crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	tls "github.com/refraction-networking/utls"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// setTestGlobal replaces a package variable until the test ends
+func setTestGlobal[T any](t *testing.T, global *T, value T) {
+	previous := *global
+	*global = value
+	t.Cleanup(func() { *global = previous })
+}
+
+func newTestCertConfig(t *testing.T, nameConstraints *CaNameConstraints) *CertConfig {
+	t.Helper()
+	config, err := NewCertConfig(t.TempDir(), nil, nil, KeyTypeEcdsaP256, KeyTypeEcdsaP256, nameConstraints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func parseLeaf(t *testing.T, certPEM []byte) *x509.Certificate {
+	t.Helper()
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		t.Fatal("no PEM certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// buildClientHello applies the spec to a client and builds the ClientHello it would send. GREASE values are random
+// on every call.
+func buildClientHello(t *testing.T, spec *tls.ClientHelloSpec) *tls.UConn {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+	uconn := tls.UClient(clientConn, &tls.Config{ServerName: "example.com"}, tls.HelloCustom)
+	if err := uconn.ApplyPreset(spec); err != nil {
+		t.Fatal(err)
+	}
+	if err := uconn.BuildHandshakeState(); err != nil {
+		t.Fatal(err)
+	}
+	return uconn
+}
+
+// clientHelloExtensionData returns the payload of an extension in a ClientHello handshake message
+func clientHelloExtensionData(t *testing.T, raw []byte, id uint16) []byte {
+	t.Helper()
+	s := cryptobyte.String(raw)
+	var sessionId, cipherSuites, compressionMethods, extensions cryptobyte.String
+	if !s.Skip(4+2+32) || !s.ReadUint8LengthPrefixed(&sessionId) || !s.ReadUint16LengthPrefixed(&cipherSuites) ||
+		!s.ReadUint8LengthPrefixed(&compressionMethods) || !s.ReadUint16LengthPrefixed(&extensions) {
+		t.Fatal("malformed ClientHello")
+	}
+	for !extensions.Empty() {
+		var extId uint16
+		var data cryptobyte.String
+		if !extensions.ReadUint16(&extId) || !extensions.ReadUint16LengthPrefixed(&data) {
+			t.Fatal("malformed ClientHello extension")
+		}
+		if extId == id {
+			return data
+		}
+	}
+	return nil
+}
+
+// serveTest accepts connections until the test ends and returns the listener address
+func serveTest(t *testing.T, listener net.Listener, serve func(conn net.Conn)) string {
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serve(conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func listenTest(t *testing.T, serve func(conn net.Conn)) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveTest(t, listener, serve)
+}
+
+// startTestTlsServer serves tls for ech.example.com with a certificate of a test CA. Every connection is sent "ok".
+func startTestTlsServer(t *testing.T, configure func(config *stdtls.Config)) (string, *CertConfig) {
+	t.Helper()
+	certConfig := newTestCertConfig(t, nil)
+	certPEM, _, err := certConfig.CreateCert("ech.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := stdtls.X509KeyPair(certPEM, []byte(certConfig.privateKeyPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &stdtls.Config{Certificates: []stdtls.Certificate{certificate}}
+	if configure != nil {
+		configure(config)
+	}
+	listener, err := stdtls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveTest(t, listener, func(conn net.Conn) {
+		if conn.(*stdtls.Conn).Handshake() == nil {
+			conn.Write([]byte("ok"))
+		}
+	}), certConfig
+}
+
+// emulateTestConnection connects to a startTestTlsServer with the ClientHello of chrome 131
+func emulateTestConnection(t *testing.T, addr string, sessionArgs SessionArgs, echConfigList []byte) (*tls.UConn, error) {
+	t.Helper()
+	uTlsConn, _, err := emulateTestTls(t, addr, sessionArgs, echConfigList)
+	return uTlsConn, err
+}
+
+// emulateTestTls is emulateTestConnection that also returns how the connection was established
+func emulateTestTls(t *testing.T, addr string, sessionArgs SessionArgs, echConfigList []byte) (*tls.UConn, *EmulatedTls, error) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	sessionArgs.ClientHelloId = "chrome-131"
+	if err = InitClientHelloVersions(sessionArgs); err != nil {
+		t.Fatal(err)
+	}
+	connectArgs := ConnectArgs{Host: "127.0.0.1", Servername: "ech.example.com"}
+	return EmulateTls(conn, addr, sessionArgs, connectArgs, func() []byte { return echConfigList })
+}
+
+// testResolver answers lookups with answer and counts them
+type testResolver struct {
+	lookups atomic.Int32
+	answer  func(network string, host string) ([]net.IP, error)
+}
+
+func (r *testResolver) LookupIP(ctx context.Context, network string, host string) ([]net.IP, error) {
+	r.lookups.Add(1)
+	return r.answer(network, host)
+}
+
+// selfSignedPEM signs template with its own key, eg, an upstream certificate to mirror
+func selfSignedPEM(t *testing.T, template *x509.Certificate, key crypto.Signer) string {
+	t.Helper()
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+// captureIpc records the messages sent with SendToIpc
+func captureIpc(t *testing.T) func() []map[string]interface{} {
+	t.Helper()
+	var sent bytes.Buffer
+	setTestGlobal(t, &encoder, json.NewEncoder(&sent))
+	return func() []map[string]interface{} {
+		var messages []map[string]interface{}
+		decoder := json.NewDecoder(bytes.NewReader(sent.Bytes()))
+		for decoder.More() {
+			var message map[string]interface{}
+			if err := decoder.Decode(&message); err != nil {
+				t.Fatal(err)
+			}
+			messages = append(messages, message)
+		}
+		return messages
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import "strings"
+
+// findByHost looks up a per-host session setting. Keys are lowercase hostnames or *.domain wildcards that match
+// any subdomain. The most specific key wins.
+func findByHost[T any](entries map[string]T, host string) (T, bool) {
+	host = strings.ToLower(host)
+	if entry, ok := entries[host]; ok {
+		return entry, true
+	}
+	for labels := host; strings.Contains(labels, "."); {
+		_, labels, _ = strings.Cut(labels, ".")
+		if entry, ok := entries["*."+labels]; ok {
+			return entry, true
+		}
+	}
+	var empty T
+	return empty, false
+}
+
+func connectHost(connectArgs ConnectArgs) string {
+	if connectArgs.Servername != "" {
+		return connectArgs.Servername
+	}
+	return connectArgs.Host
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// replacement that makes a mapped host fail to resolve
+const hostResolverNotFound = "~NOTFOUND"
+
+// hostResolverRule is one entry of Chrome's --host-resolver-rules, eg, "MAP *.example.com 127.0.0.1:8443" or
+// "EXCLUDE api.example.com". Patterns can use * and ? wildcards.
+type hostResolverRule struct {
+	isExclude   bool
+	pattern     string
+	replacement string
+	// empty keeps the port of the connection
+	port string
+}
+
+// rules from SessionArgs.HostResolverRules, applied in order to direct connections
+var hostResolverRules []hostResolverRule
+
+// ParseHostResolverRules reads comma separated MAP and EXCLUDE rules
+func ParseHostResolverRules(rules string) ([]hostResolverRule, error) {
+	var parsed []hostResolverRule
+	for _, rule := range strings.Split(rules, ",") {
+		parts := strings.Fields(rule)
+		if len(parts) == 0 {
+			continue
+		}
+		switch {
+		case strings.EqualFold(parts[0], "EXCLUDE") && len(parts) == 2:
+			parsed = append(parsed, hostResolverRule{isExclude: true, pattern: strings.ToLower(parts[1])})
+
+		case strings.EqualFold(parts[0], "MAP") && len(parts) == 3:
+			parsedRule := hostResolverRule{pattern: strings.ToLower(parts[1]), replacement: parts[2]}
+			if parts[2] != hostResolverNotFound {
+				host, port, err := net.SplitHostPort(parts[2])
+				if err == nil {
+					if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+						return nil, fmt.Errorf("Invalid port in host resolver rule %q", strings.TrimSpace(rule))
+					}
+					parsedRule.replacement = host
+					parsedRule.port = port
+				}
+				// bracketed ipv6 without a port
+				parsedRule.replacement = strings.TrimSuffix(strings.TrimPrefix(parsedRule.replacement, "["), "]")
+			}
+			parsed = append(parsed, parsedRule)
+
+		default:
+			return nil, fmt.Errorf("Invalid host resolver rule %q. Expected MAP <pattern> <host[:port]> or EXCLUDE <pattern>.", strings.TrimSpace(rule))
+		}
+	}
+	return parsed, nil
+}
+
+// mapHost applies the first rule matching the host. EXCLUDE rules stop later rules from mapping it.
+func mapHost(rules []hostResolverRule, host string, port string) (string, string, error) {
+	lowerHost := strings.ToLower(host)
+	for _, rule := range rules {
+		if !matchHostPattern(rule.pattern, lowerHost) {
+			continue
+		}
+		if rule.isExclude {
+			break
+		}
+		if rule.replacement == hostResolverNotFound {
+			return "", "", &net.DNSError{Err: "no such host (host resolver rules)", Name: host, IsNotFound: true}
+		}
+		if rule.port != "" {
+			port = rule.port
+		}
+		return rule.replacement, port, nil
+	}
+	return host, port, nil
+}
+
+// matchHostPattern matches * (any characters) and ? (one character) wildcards
+func matchHostPattern(pattern string, host string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			pattern = strings.TrimLeft(pattern, "*")
+			if pattern == "" {
+				return true
+			}
+			for i := 0; i <= len(host); i++ {
+				if matchHostPattern(pattern, host[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if host == "" {
+				return false
+			}
+		default:
+			if host == "" || host[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		host = host[1:]
+	}
+	return host == ""
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHostResolverRules(t *testing.T) {
+	rules, err := ParseHostResolverRules("EXCLUDE api.example.com, MAP *.example.com 127.0.0.1:8443, MAP blocked.test ~NOTFOUND, MAP v6.test [::1]:9000, MAP ?.test 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"www.example.com", "127.0.0.1:8443"},
+		{"WWW.Example.com", "127.0.0.1:8443"},
+		// excluded hosts aren't mapped by later rules
+		{"api.example.com", "api.example.com:443"},
+		{"example.com", "example.com:443"},
+		{"v6.test", "[::1]:9000"},
+		{"a.test", "192.0.2.1:443"},
+		{"ab.test", "ab.test:443"},
+	}
+	for _, test := range tests {
+		host, port, err := mapHost(rules, test.host, "443")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := net.JoinHostPort(host, port); got != test.want {
+			t.Errorf("%s: expected %s, got %s", test.host, test.want, got)
+		}
+	}
+
+	_, _, err = mapHost(rules, "blocked.test", "443")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Fatalf("expected ~NOTFOUND to fail like a missing host, got %v", err)
+	}
+}
+
+func TestInvalidHostResolverRules(t *testing.T) {
+	for _, rules := range []string{"MAP example.com", "MAP example.com 127.0.0.1:99999", "EXCLUDE", "REDIRECT example.com 127.0.0.1"} {
+		if _, err := ParseHostResolverRules(rules); err == nil {
+			t.Errorf("expected %q to be rejected", rules)
+		}
+	}
+}
+
+func TestDialMappedHostSkipsDns(t *testing.T) {
+	resolver := &testResolver{answer: func(network string, host string) ([]net.IP, error) {
+		return nil, errors.New("unexpected lookup")
+	}}
+	setTestGlobal[Resolver](t, &dnsResolver, resolver)
+	fixtureAddr := listenTest(t, func(conn net.Conn) {})
+	rules, err := ParseHostResolverRules("MAP production.example.com " + fixtureAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setTestGlobal(t, &hostResolverRules, rules)
+
+	conn, info, err := DialHappyEyeballs(net.Dialer{Timeout: 5 * time.Second}, "production.example.com:443", SessionArgs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if conn.RemoteAddr().String() != fixtureAddr || info.DnsResolvedIp != "127.0.0.1" || resolver.lookups.Load() != 0 {
+		t.Fatalf("expected a connection to the mapped fixture without a lookup, got %s %+v", conn.RemoteAddr(), info)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// CaNameConstraints limits the names a generated CA can issue for (RFC 5280 name constraints). A domain matches
+// itself and its subdomains, a domain with a leading "." only its subdomains. IP ranges are CIDRs.
+type CaNameConstraints struct {
+	PermittedDnsDomains []string
+	ExcludedDnsDomains  []string
+	PermittedIpRanges   []string
+	ExcludedIpRanges    []string
+}
+
+// NameConstraintError is returned when a certificate is requested for a name the CA is not allowed to issue for
+type NameConstraintError struct {
+	Name string
+}
+
+func (e *NameConstraintError) Error() string {
+	return fmt.Sprintf("%s is outside the name constraints of the CA", e.Name)
+}
+
+func (n *CaNameConstraints) isEmpty() bool {
+	return n == nil || len(n.PermittedDnsDomains)+len(n.ExcludedDnsDomains)+len(n.PermittedIpRanges)+len(n.ExcludedIpRanges) == 0
+}
+
+// Apply sets the constraints on a CA template
+func (n *CaNameConstraints) Apply(tmpl *x509.Certificate) error {
+	if n.isEmpty() {
+		return nil
+	}
+	permittedIpRanges, err := parseIpRanges(n.PermittedIpRanges)
+	if err != nil {
+		return err
+	}
+	excludedIpRanges, err := parseIpRanges(n.ExcludedIpRanges)
+	if err != nil {
+		return err
+	}
+	// without ip constraints, a CA limited to dns names could still issue for any ip address (RFC 5280 4.2.1.10)
+	if len(permittedIpRanges) == 0 && len(n.PermittedDnsDomains)+len(n.ExcludedDnsDomains) > 0 {
+		excludedIpRanges = append(excludedIpRanges, allIpRanges()...)
+	}
+	tmpl.PermittedDNSDomainsCritical = true
+	tmpl.PermittedDNSDomains = normalizeDomains(n.PermittedDnsDomains)
+	tmpl.ExcludedDNSDomains = normalizeDomains(n.ExcludedDnsDomains)
+	tmpl.PermittedIPRanges = permittedIpRanges
+	tmpl.ExcludedIPRanges = excludedIpRanges
+	return nil
+}
+
+func allIpRanges() []*net.IPNet {
+	return []*net.IPNet{
+		{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)},
+		{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)},
+	}
+}
+
+// MatchesAuthority returns if a CA has exactly these constraints (a CA on disk is replaced if the configuration changed)
+func (n *CaNameConstraints) MatchesAuthority(ca *x509.Certificate) bool {
+	var expected x509.Certificate
+	if err := n.Apply(&expected); err != nil {
+		return false
+	}
+	return sameNames(expected.PermittedDNSDomains, ca.PermittedDNSDomains) &&
+		sameNames(expected.ExcludedDNSDomains, ca.ExcludedDNSDomains) &&
+		sameNames(ipNetStrings(expected.PermittedIPRanges), ipNetStrings(ca.PermittedIPRanges)) &&
+		sameNames(ipNetStrings(expected.ExcludedIPRanges), ipNetStrings(ca.ExcludedIPRanges))
+}
+
+// checkNameConstraints verifies a CA is allowed to issue for the dns names and ips. Dns names are only constrained
+// if the CA has dns constraints. A CA with only dns constraints can't issue for ips (see Apply).
+func checkNameConstraints(ca *x509.Certificate, dnsNames []string, ips []net.IP) error {
+	hasDnsConstraints := len(ca.PermittedDNSDomains)+len(ca.ExcludedDNSDomains) > 0
+	hasIpConstraints := len(ca.PermittedIPRanges)+len(ca.ExcludedIPRanges) > 0
+	if hasDnsConstraints && !hasIpConstraints && len(ips) > 0 {
+		return &NameConstraintError{Name: ips[0].String()}
+	}
+
+	for _, name := range dnsNames {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		isPermitted := len(ca.PermittedDNSDomains) == 0
+		for _, domain := range ca.PermittedDNSDomains {
+			if matchesDomain(name, domain) {
+				isPermitted = true
+				break
+			}
+		}
+		for _, domain := range ca.ExcludedDNSDomains {
+			if matchesDomain(name, domain) {
+				isPermitted = false
+				break
+			}
+		}
+		if !isPermitted {
+			return &NameConstraintError{Name: name}
+		}
+	}
+
+	for _, ip := range ips {
+		isPermitted := len(ca.PermittedIPRanges) == 0
+		for _, ipRange := range ca.PermittedIPRanges {
+			if ipRange.Contains(ip) {
+				isPermitted = true
+				break
+			}
+		}
+		for _, ipRange := range ca.ExcludedIPRanges {
+			if ipRange.Contains(ip) {
+				isPermitted = false
+				break
+			}
+		}
+		if !isPermitted {
+			return &NameConstraintError{Name: ip.String()}
+		}
+	}
+	return nil
+}
+
+func matchesDomain(name string, domain string) bool {
+	domain = strings.ToLower(domain)
+	if strings.HasPrefix(domain, ".") {
+		return strings.HasSuffix(name, domain)
+	}
+	return name == domain || strings.HasSuffix(name, "."+domain)
+}
+
+func normalizeDomains(domains []string) []string {
+	var normalized []string
+	for _, domain := range domains {
+		normalized = append(normalized, strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), ".")))
+	}
+	return normalized
+}
+
+func parseIpRanges(cidrs []string) ([]*net.IPNet, error) {
+	var ranges []*net.IPNet
+	for _, cidr := range cidrs {
+		_, ipRange, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid name constraint IP range %s (%s)", cidr, err)
+		}
+		ranges = append(ranges, ipRange)
+	}
+	return ranges, nil
+}
+
+func ipNetStrings(ranges []*net.IPNet) []string {
+	var names []string
+	for _, ipRange := range ranges {
+		names = append(names, ipRange.String())
+	}
+	return names
+}
+
+func sameNames(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string{}, a...)
+	b = append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDnsOnlyConstraintsExcludeIps(t *testing.T) {
+	config := newTestCertConfig(t, &CaNameConstraints{PermittedDnsDomains: []string{"example.com"}})
+
+	if len(config.ca.ExcludedIPRanges) != 2 {
+		t.Fatalf("expected all ipv4 and ipv6 ranges to be excluded, got %v", config.ca.ExcludedIPRanges)
+	}
+
+	certPEM, _, err := config.CreateCert("www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(config.ca)
+	_, err = parseLeaf(t, certPEM).Verify(x509.VerifyOptions{Roots: roots, DNSName: "www.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, host := range []string{"127.0.0.1", "::1", "other.com"} {
+		_, _, err = config.CreateCert(host)
+		var constraintErr *NameConstraintError
+		if !errors.As(err, &constraintErr) {
+			t.Fatalf("expected a name constraint error for %s, got %v", host, err)
+		}
+	}
+
+	upstreamKey, err := generateKey(KeyTypeEcdsaP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "www.example.com"},
+		DNSNames:     []string{"www.example.com"},
+		IPAddresses:  []net.IP{net.ParseIP("10.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	upstreamDer, err := x509.CreateCertificate(rand.Reader, upstream, upstream, upstreamKey.Public(), upstreamKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, err = config.MirrorCert("www.example.com", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstreamDer})))
+	var constraintErr *NameConstraintError
+	if !errors.As(err, &constraintErr) {
+		t.Fatalf("expected mirroring an ip SAN to fail, got %v", err)
+	}
+
+	// a leaked CA key signing an ip certificate directly is rejected by verification
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "10.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("10.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	leafDer, err := x509.CreateCertificate(rand.Reader, leaf, config.ca, config.publicKey, config.caPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafCert, err := x509.ParseCertificate(leafDer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = leafCert.Verify(x509.VerifyOptions{Roots: roots})
+	var invalidErr x509.CertificateInvalidError
+	if !errors.As(err, &invalidErr) || invalidErr.Reason != x509.CANotAuthorizedForThisName {
+		t.Fatalf("expected verification to fail with CANotAuthorizedForThisName, got %v", err)
+	}
+}
+
+func TestNameConstraintsReplaceUnconstrainedCa(t *testing.T) {
+	storageDir := t.TempDir()
+	ca, _, err := NewAuthority(storageDir, KeyTypeEcdsaP256, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	constraints := &CaNameConstraints{PermittedDnsDomains: []string{"example.com"}, ExcludedDnsDomains: []string{"admin.example.com"}}
+	constrained, _, err := NewAuthority(storageDir, KeyTypeEcdsaP256, constraints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if constrained.Equal(ca) || !constraints.MatchesAuthority(constrained) {
+		t.Fatal("expected the CA to be replaced with a constrained CA")
+	}
+
+	if err = checkNameConstraints(constrained, []string{"admin.example.com"}, nil); err == nil {
+		t.Fatal("expected an excluded domain to be refused")
+	}
+	if err = checkNameConstraints(constrained, []string{"api.example.com"}, nil); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+)
+
+// Pkcs11Config selects a CA private key on a PKCS#11 token (HSM, SoftHSM2, ...). The key never leaves the token.
+// The CA certificate is read from CaCertPath, the token (an object with the same label/id), or is self-signed with
+// the token key and saved to the cert storage dir.
+type Pkcs11Config struct {
+	// path of the module library, eg, /usr/lib/softhsm/libsofthsm2.so
+	ModulePath string
+	// token label or slot id
+	TokenLabel string
+	SlotId     *uint
+	// user pin. PinEnv names an environment variable with the pin so it isn't part of the process arguments.
+	Pin    string
+	PinEnv string
+	// label and/or hex id of the private key
+	KeyLabel string
+	KeyId    string
+}
+
+var oidPublicKeyEcdsa = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+
+// DigestInfo prefixes for PKCS#1 v1.5 signatures. CKM_RSA_PKCS only pads, so the prefix is added before signing.
+var pkcs1DigestInfoPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA1:   {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// loadPkcs11Authority opens the token key and finds (or creates) the matching CA certificate
+func loadPkcs11Authority(config *Pkcs11Config, caCertPath string, storageDir string, nameConstraints *CaNameConstraints) (*x509.Certificate, crypto.Signer, error) {
+	if config.ModulePath == "" {
+		return nil, nil, errors.New("CaPkcs11 needs a ModulePath")
+	}
+	if config.KeyLabel == "" && config.KeyId == "" {
+		return nil, nil, errors.New("CaPkcs11 needs a KeyLabel or KeyId")
+	}
+
+	var ca *x509.Certificate
+	var caPublicKey crypto.PublicKey
+	if caCertPath != "" {
+		certBytes, err := readPemOrDer(caCertPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		ca, err = x509.ParseCertificate(certBytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		caPublicKey = ca.PublicKey
+	}
+
+	// the public key is read from the token. Tokens without public key objects need the CA certificate.
+	signer, tokenCert, err := openPkcs11Signer(config, caPublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ca == nil {
+		ca = tokenCert
+	}
+	if ca != nil {
+		return ca, signer, validateAuthority(ca, signer)
+	}
+
+	caFile := filepath.Join(storageDir, "ca.der")
+	ca, err = readCertFromDisk(caFile)
+	if err == nil && validateAuthority(ca, signer) == nil && nameConstraints.MatchesAuthority(ca) {
+		return ca, signer, nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Print("Error reading cert from disk", caFile, err)
+	}
+
+	raw, err := createAuthorityCertificate(signer, nameConstraints)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = os.WriteFile(caFile, raw, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	ca, err = x509.ParseCertificate(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ca, signer, nil
+}
+
+func (config *Pkcs11Config) pin() string {
+	if config.PinEnv != "" {
+		return os.Getenv(config.PinEnv)
+	}
+	return config.Pin
+}
+
+// rsaPublicKeyFromAttributes builds a public key from CKA_MODULUS and CKA_PUBLIC_EXPONENT
+func rsaPublicKeyFromAttributes(modulus []byte, exponent []byte) (crypto.PublicKey, error) {
+	e := new(big.Int).SetBytes(exponent)
+	if len(modulus) == 0 || !e.IsInt64() || e.Int64() > 1<<31-1 {
+		return nil, errors.New("Invalid RSA public key on the PKCS#11 token")
+	}
+	type pkcs1PublicKey struct {
+		N *big.Int
+		E int
+	}
+	der, err := asn1.Marshal(pkcs1PublicKey{N: new(big.Int).SetBytes(modulus), E: int(e.Int64())})
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParsePKCS1PublicKey(der)
+}
+
+// ecdsaPublicKeyFromAttributes builds a public key from CKA_EC_PARAMS (the curve oid) and CKA_EC_POINT
+func ecdsaPublicKeyFromAttributes(ecParams []byte, ecPoint []byte) (crypto.PublicKey, error) {
+	// the point is a DER octet string, but some tokens return the raw point
+	var point []byte
+	if rest, err := asn1.Unmarshal(ecPoint, &point); err != nil || len(rest) > 0 {
+		point = ecPoint
+	}
+	spki, err := asn1.Marshal(struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}{
+		Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidPublicKeyEcdsa, Parameters: asn1.RawValue{FullBytes: ecParams}},
+		PublicKey: asn1.BitString{Bytes: point, BitLength: len(point) * 8},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParsePKIXPublicKey(spki)
+}
+
+// ecdsaSignatureToAsn1 converts a PKCS#11 signature (r || s) to the DER encoding x509 expects
+func ecdsaSignatureToAsn1(signature []byte) ([]byte, error) {
+	if len(signature) == 0 || len(signature)%2 != 0 {
+		return nil, fmt.Errorf("Invalid ECDSA signature length %d", len(signature))
+	}
+	half := len(signature) / 2
+	return asn1.Marshal(struct {
+		R, S *big.Int
+	}{
+		R: new(big.Int).SetBytes(signature[:half]),
+		S: new(big.Int).SetBytes(signature[half:]),
+	})
+}
@@ -0,0 +1,237 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// pkcs11Signer signs with a private key that stays on a PKCS#11 token. A session can only run one operation at a
+// time, so signing is serialized.
+type pkcs11Signer struct {
+	sync.Mutex
+	ctx       *pkcs11.Ctx
+	session   pkcs11.SessionHandle
+	key       pkcs11.ObjectHandle
+	publicKey crypto.PublicKey
+}
+
+var pkcs11HashMechanisms = map[crypto.Hash]struct{ hash, mgf uint }{
+	crypto.SHA1:   {pkcs11.CKM_SHA_1, pkcs11.CKG_MGF1_SHA1},
+	crypto.SHA256: {pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256},
+	crypto.SHA384: {pkcs11.CKM_SHA384, pkcs11.CKG_MGF1_SHA384},
+	crypto.SHA512: {pkcs11.CKM_SHA512, pkcs11.CKG_MGF1_SHA512},
+}
+
+// openPkcs11Signer logs into the token and finds the private key. Returns a certificate stored next to the key
+// on the token if there is one.
+func openPkcs11Signer(config *Pkcs11Config, publicKey crypto.PublicKey) (crypto.Signer, *x509.Certificate, error) {
+	ctx := pkcs11.New(config.ModulePath)
+	if ctx == nil {
+		return nil, nil, fmt.Errorf("Unable to load PKCS#11 module %s", config.ModulePath)
+	}
+	err := ctx.Initialize()
+	if err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED)) {
+		return nil, nil, err
+	}
+
+	slot, err := findPkcs11Slot(ctx, config)
+	if err != nil {
+		return nil, nil, err
+	}
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = ctx.Login(session, pkcs11.CKU_USER, config.pin())
+	if err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)) {
+		return nil, nil, fmt.Errorf("PKCS#11 login failed (%s)", err)
+	}
+
+	var template []*pkcs11.Attribute
+	if config.KeyLabel != "" {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_LABEL, config.KeyLabel))
+	}
+	if config.KeyId != "" {
+		id, err := hex.DecodeString(config.KeyId)
+		if err != nil {
+			return nil, nil, fmt.Errorf("CaPkcs11 KeyId is not hex (%s)", err)
+		}
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, id))
+	}
+
+	keys, err := findPkcs11Objects(ctx, session, pkcs11.CKO_PRIVATE_KEY, template)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(keys) != 1 {
+		return nil, nil, fmt.Errorf("Expected 1 private key on the PKCS#11 token with label %q/id %q. Found %d.", config.KeyLabel, config.KeyId, len(keys))
+	}
+
+	var tokenCert *x509.Certificate
+	certs, err := findPkcs11Objects(ctx, session, pkcs11.CKO_CERTIFICATE, template)
+	if err == nil && len(certs) > 0 {
+		attributes, err := ctx.GetAttributeValue(session, certs[0], []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil)})
+		if err == nil {
+			tokenCert, _ = x509.ParseCertificate(attributes[0].Value)
+		}
+	}
+
+	if tokenPublicKey, err := readPkcs11PublicKey(ctx, session, template); err == nil {
+		publicKey = tokenPublicKey
+	} else if publicKey == nil && tokenCert != nil {
+		publicKey = tokenCert.PublicKey
+	}
+	if publicKey == nil {
+		return nil, nil, errors.New("The PKCS#11 token has no public key or certificate for the CA key. Set CaCertPath.")
+	}
+
+	return &pkcs11Signer{ctx: ctx, session: session, key: keys[0], publicKey: publicKey}, tokenCert, nil
+}
+
+func (s *pkcs11Signer) Public() crypto.PublicKey {
+	return s.publicKey
+}
+
+func (s *pkcs11Signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var mechanism *pkcs11.Mechanism
+	message := digest
+
+	switch s.publicKey.(type) {
+	case *rsa.PublicKey:
+		if pssOptions, ok := opts.(*rsa.PSSOptions); ok {
+			hashMechanism, ok := pkcs11HashMechanisms[opts.HashFunc()]
+			if !ok {
+				return nil, fmt.Errorf("Unsupported hash for PKCS#11 signing %s", opts.HashFunc())
+			}
+			saltLength := pssOptions.SaltLength
+			if saltLength <= 0 {
+				saltLength = opts.HashFunc().Size()
+			}
+			params := pkcs11.NewPSSParams(hashMechanism.hash, hashMechanism.mgf, uint(saltLength))
+			mechanism = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_PSS, params)
+		} else {
+			prefix, ok := pkcs1DigestInfoPrefixes[opts.HashFunc()]
+			if !ok {
+				return nil, fmt.Errorf("Unsupported hash for PKCS#11 signing %s", opts.HashFunc())
+			}
+			message = append(append([]byte{}, prefix...), digest...)
+			mechanism = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)
+		}
+	case *ecdsa.PublicKey:
+		mechanism = pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)
+	default:
+		return nil, fmt.Errorf("Unsupported PKCS#11 key %T", s.publicKey)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	err := s.ctx.SignInit(s.session, []*pkcs11.Mechanism{mechanism}, s.key)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := s.ctx.Sign(s.session, message)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := s.publicKey.(*ecdsa.PublicKey); ok {
+		return ecdsaSignatureToAsn1(signature)
+	}
+	return signature, nil
+}
+
+func findPkcs11Slot(ctx *pkcs11.Ctx, config *Pkcs11Config) (uint, error) {
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return 0, err
+	}
+	for _, slot := range slots {
+		if config.SlotId != nil {
+			if slot == *config.SlotId {
+				return slot, nil
+			}
+			continue
+		}
+		if config.TokenLabel == "" {
+			return slot, nil
+		}
+		tokenInfo, err := ctx.GetTokenInfo(slot)
+		if err == nil && strings.TrimSpace(tokenInfo.Label) == config.TokenLabel {
+			return slot, nil
+		}
+	}
+	return 0, fmt.Errorf("No PKCS#11 token found with label %q", config.TokenLabel)
+}
+
+func findPkcs11Objects(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, class uint, template []*pkcs11.Attribute) ([]pkcs11.ObjectHandle, error) {
+	search := append([]*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, class)}, template...)
+	err := ctx.FindObjectsInit(session, search)
+	if err != nil {
+		return nil, err
+	}
+	objects, _, err := ctx.FindObjects(session, 2)
+	finalErr := ctx.FindObjectsFinal(session)
+	if err != nil {
+		return nil, err
+	}
+	return objects, finalErr
+}
+
+func readPkcs11PublicKey(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, template []*pkcs11.Attribute) (crypto.PublicKey, error) {
+	objects, err := findPkcs11Objects(ctx, session, pkcs11.CKO_PUBLIC_KEY, template)
+	if err != nil {
+		return nil, err
+	}
+	if len(objects) == 0 {
+		return nil, errors.New("No public key object on the PKCS#11 token")
+	}
+
+	attributes, err := ctx.GetAttributeValue(session, objects[0], []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, nil)})
+	if err != nil {
+		return nil, err
+	}
+	// CK_ULONG in native byte order
+	var keyType uint
+	switch value := attributes[0].Value; len(value) {
+	case 8:
+		keyType = uint(binary.NativeEndian.Uint64(value))
+	case 4:
+		keyType = uint(binary.NativeEndian.Uint32(value))
+	}
+
+	switch keyType {
+	case pkcs11.CKK_RSA:
+		attributes, err = ctx.GetAttributeValue(session, objects[0], []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return rsaPublicKeyFromAttributes(attributes[0].Value, attributes[1].Value)
+	case pkcs11.CKK_EC:
+		attributes, err = ctx.GetAttributeValue(session, objects[0], []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return ecdsaPublicKeyFromAttributes(attributes[0].Value, attributes[1].Value)
+	}
+	return nil, fmt.Errorf("Unsupported PKCS#11 key type %d", keyType)
+}
@@ -0,0 +1,15 @@
+//go:build !cgo
+// +build !cgo
+
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+)
+
+// PKCS#11 modules are C libraries. Builds without cgo can't load them (released binaries are built with cgo).
+func openPkcs11Signer(config *Pkcs11Config, publicKey crypto.PublicKey) (crypto.Signer, *x509.Certificate, error) {
+	return nil, nil, errors.New("CaPkcs11 needs a build with cgo enabled (CGO_ENABLED=1 and a C compiler)")
+}
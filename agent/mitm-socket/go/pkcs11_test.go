@@ -0,0 +1,117 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+var softHsmModulePaths = []string{
+	"/usr/lib/softhsm/libsofthsm2.so",
+	"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/lib/aarch64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/local/lib/softhsm/libsofthsm2.so",
+	"/opt/homebrew/lib/softhsm/libsofthsm2.so",
+}
+
+// newSoftHsmToken initializes a SoftHSM2 token in a temp dir and imports an ecdsa key labeled "ca"
+func newSoftHsmToken(t *testing.T) *Pkcs11Config {
+	t.Helper()
+	softHsmUtil, err := exec.LookPath("softhsm2-util")
+	if err != nil {
+		t.Skip("softhsm2-util is not installed")
+	}
+	var modulePath string
+	for _, path := range softHsmModulePaths {
+		if _, err := os.Stat(path); err == nil {
+			modulePath = path
+			break
+		}
+	}
+	if modulePath == "" {
+		t.Skip("libsofthsm2.so was not found")
+	}
+
+	dir := t.TempDir()
+	tokenDir := filepath.Join(dir, "tokens")
+	if err = os.Mkdir(tokenDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	conf := filepath.Join(dir, "softhsm2.conf")
+	if err = os.WriteFile(conf, []byte("directories.tokendir = "+tokenDir+"\nobjectstore.backend = file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SOFTHSM2_CONF", conf)
+
+	key, err := generateKey(KeyTypeEcdsaP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "key.pem")
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	commands := [][]string{
+		{"--init-token", "--free", "--label", "test", "--pin", "1234", "--so-pin", "5678"},
+		{"--import", keyFile, "--token", "test", "--label", "ca", "--id", "01", "--pin", "1234"},
+	}
+	for _, args := range commands {
+		if output, err := exec.Command(softHsmUtil, args...).CombinedOutput(); err != nil {
+			t.Fatalf("softhsm2-util %s failed (%s) %s", args[0], err, output)
+		}
+	}
+	t.Setenv("TEST_PKCS11_PIN", "1234")
+	return &Pkcs11Config{ModulePath: modulePath, TokenLabel: "test", PinEnv: "TEST_PKCS11_PIN", KeyLabel: "ca"}
+}
+
+func TestPkcs11SignsLeafCertificates(t *testing.T) {
+	pkcs11Config := newSoftHsmToken(t)
+	storageDir := t.TempDir()
+
+	ca, signer, err := loadPkcs11Authority(pkcs11Config, "", storageDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(storageDir, "caKey.der")); !os.IsNotExist(err) {
+		t.Fatal("expected the CA key to stay on the token")
+	}
+	config, err := NewCertConfig(storageDir, ca, signer, "", KeyTypeEcdsaP256, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, _, err := config.CreateCert("hsm.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	if _, err = parseLeaf(t, certPEM).Verify(x509.VerifyOptions{Roots: roots, DNSName: "hsm.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// certs export uses the token CA instead of generating a software CA
+	out := filepath.Join(t.TempDir(), "ca.der")
+	err = RunCertsCommand([]string{"export", "--format", "der", "--dir", storageDir, "--out", out,
+		"--pkcs11-module", pkcs11Config.ModulePath, "--pkcs11-token", "test", "--pkcs11-key-label", "ca", "--pkcs11-pin-env", "TEST_PKCS11_PIN"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported, err := readCertFromDisk(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exported.Equal(ca) {
+		t.Fatal("expected the exported CA to be the PKCS#11 CA")
+	}
+}
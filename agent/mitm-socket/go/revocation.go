@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+var revocationServer *RevocationServer
+
+// ocsp responses and crls are valid for this long. Clients re-fetch after it.
+const revocationValidity = time.Hour
+
+const maxOcspRequestSize = 64 * 1024
+
+// RevocationServer is a local OCSP responder and CRL endpoint for certificates issued by the CA. Revoked serial
+// numbers are persisted in the cert storage dir.
+type RevocationServer struct {
+	sync.Mutex
+	config   *CertConfig
+	revoked  map[string]*revokedCert
+	path     string
+	listener net.Listener
+}
+
+type revokedCert struct {
+	RevokedAt int64
+	// RFC 5280 CRLReason (0 unspecified, 1 key compromise, 4 superseded, 5 cessation of operation, ...)
+	Reason int
+}
+
+// StartRevocationServer listens on address (eg, 127.0.0.1:0) and embeds the urls in certificates created by config
+func StartRevocationServer(config *CertConfig, address string) (*RevocationServer, error) {
+	// x/crypto/ocsp only signs responses with rsa and ecdsa keys. Rotated CAs keep the key type.
+	if ca, _, _ := config.authority(); ca.PublicKeyAlgorithm == x509.Ed25519 {
+		return nil, errors.New("The revocation server can't sign OCSP responses with an Ed25519 CA (use an rsa or ecdsa CaKeyType)")
+	}
+
+	server := &RevocationServer{
+		config:  config,
+		revoked: make(map[string]*revokedCert),
+		path:    filepath.Join(config.storageDir, "revoked.json"),
+	}
+	err := server.load()
+	if err != nil {
+		return nil, err
+	}
+
+	server.listener, err = net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ocsp", server.handleOcsp)
+	mux.HandleFunc("/crl", server.handleCrl)
+	mux.HandleFunc("/ca", server.handleCa)
+	go http.Serve(server.listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// base64 GET requests can contain "//", which ServeMux would clean and redirect
+		if strings.HasPrefix(r.URL.EscapedPath(), "/ocsp/") {
+			server.handleOcsp(w, r)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+
+	config.revocationUrl = "http://" + server.listener.Addr().String()
+	return server, nil
+}
+
+// Revoke marks the certificate in certPEM as revoked. It must be issued by the current CA.
+func (s *RevocationServer) Revoke(certPEM string, reason int) (*big.Int, error) {
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("Certificate to revoke is not a PEM encoded certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ca, _, _ := s.config.authority()
+	if err = cert.CheckSignatureFrom(ca); err != nil {
+		return nil, fmt.Errorf("Certificate %s was not issued by the current CA (%s)", cert.SerialNumber, err)
+	}
+
+	s.Lock()
+	s.revoked[cert.SerialNumber.String()] = &revokedCert{RevokedAt: time.Now().Unix(), Reason: reason}
+	err = s.save()
+	s.Unlock()
+
+	if certCache != nil {
+		certCache.RemoveSerialNumber(cert.SerialNumber)
+	}
+	return cert.SerialNumber, err
+}
+
+func (s *RevocationServer) load() error {
+	revokedJson, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(revokedJson, &s.revoked)
+}
+
+func (s *RevocationServer) save() error {
+	revokedJson, err := json.Marshal(s.revoked)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.path, revokedJson, 0600)
+}
+
+func (s *RevocationServer) handleOcsp(w http.ResponseWriter, r *http.Request) {
+	var requestBytes []byte
+	var err error
+	if r.Method == http.MethodGet {
+		// GET /ocsp/{url encoded base64 request}
+		var encoded string
+		encoded, err = url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/ocsp/"))
+		if err == nil {
+			requestBytes, err = base64.StdEncoding.DecodeString(encoded)
+		}
+	} else {
+		requestBytes, err = io.ReadAll(io.LimitReader(r.Body, maxOcspRequestSize))
+	}
+
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	if err != nil {
+		w.Write(ocsp.MalformedRequestErrorResponse)
+		return
+	}
+	request, err := ocsp.ParseRequest(requestBytes)
+	if err != nil {
+		w.Write(ocsp.MalformedRequestErrorResponse)
+		return
+	}
+
+	ca, caPrivateKey, _ := s.config.authority()
+	// certificates of a previous (rotated) CA can't be answered without its key
+	if !issuedBy(request, ca) {
+		w.Write(ocsp.UnauthorizedErrorResponse)
+		return
+	}
+
+	now := time.Now()
+	template := ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: request.SerialNumber,
+		ThisUpdate:   now.Add(-time.Minute),
+		NextUpdate:   now.Add(revocationValidity),
+	}
+	s.Lock()
+	if revoked, ok := s.revoked[request.SerialNumber.String()]; ok {
+		template.Status = ocsp.Revoked
+		template.RevokedAt = time.Unix(revoked.RevokedAt, 0)
+		template.RevocationReason = revoked.Reason
+	}
+	s.Unlock()
+
+	response, err := ocsp.CreateResponse(ca, ca, template, caPrivateKey)
+	if err != nil {
+		log.Printf("Error creating ocsp response. %#v", err)
+		w.Write(ocsp.InternalErrorErrorResponse)
+		return
+	}
+	w.Write(response)
+}
+
+func (s *RevocationServer) handleCrl(w http.ResponseWriter, r *http.Request) {
+	ca, caPrivateKey, _ := s.config.authority()
+	// leaf certificates of these CAs don't embed the crl url (see addRevocationUrls)
+	if ca.KeyUsage&x509.KeyUsageCRLSign == 0 {
+		http.Error(w, "The CA is not allowed to sign CRLs", http.StatusNotFound)
+		return
+	}
+
+	var entries []x509.RevocationListEntry
+	s.Lock()
+	for serialNumber, revoked := range s.revoked {
+		serial, ok := new(big.Int).SetString(serialNumber, 10)
+		if !ok {
+			continue
+		}
+		entries = append(entries, x509.RevocationListEntry{
+			SerialNumber:   serial,
+			RevocationTime: time.Unix(revoked.RevokedAt, 0),
+			ReasonCode:     revoked.Reason,
+		})
+	}
+	s.Unlock()
+
+	now := time.Now()
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(now.Unix()),
+		ThisUpdate:                now.Add(-time.Minute),
+		NextUpdate:                now.Add(revocationValidity),
+		RevokedCertificateEntries: entries,
+	}, ca, caPrivateKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pkix-crl")
+	w.Write(crl)
+}
+
+func (s *RevocationServer) handleCa(w http.ResponseWriter, r *http.Request) {
+	ca, _, _ := s.config.authority()
+	w.Header().Set("Content-Type", "application/pkix-cert")
+	w.Write(ca.Raw)
+}
+
+// issuedBy checks the issuer key hash of an ocsp request against the CA
+func issuedBy(request *ocsp.Request, ca *x509.Certificate) bool {
+	var publicKeyInfo struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(ca.RawSubjectPublicKeyInfo, &publicKeyInfo); err != nil {
+		return false
+	}
+	if !request.HashAlgorithm.Available() {
+		return false
+	}
+	h := request.HashAlgorithm.New()
+	h.Write(publicKeyInfo.PublicKey.RightAlign())
+	return string(h.Sum(nil)) == string(request.IssuerKeyHash)
+}
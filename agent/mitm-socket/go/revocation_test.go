@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func startTestRevocationServer(t *testing.T, config *CertConfig) *RevocationServer {
+	t.Helper()
+	server, err := StartRevocationServer(config, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.listener.Close() })
+	return server
+}
+
+func queryOcsp(t *testing.T, config *CertConfig, cert *x509.Certificate, useGet bool) *ocsp.Response {
+	t.Helper()
+	request, err := ocsp.CreateRequest(cert, config.ca, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response *http.Response
+	if useGet {
+		response, err = http.Get(config.revocationUrl + "/ocsp/" + base64.StdEncoding.EncodeToString(request))
+	} else {
+		response, err = http.Post(config.revocationUrl+"/ocsp", "application/ocsp-request", bytes.NewReader(request))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(response.Body)
+	parsed, err := ocsp.ParseResponseForCert(body, cert, config.ca)
+	if err != nil {
+		t.Fatalf("%s (status %d)", err, response.StatusCode)
+	}
+	return parsed
+}
+
+func TestRevocationServer(t *testing.T) {
+	config := newTestCertConfig(t, nil)
+	server := startTestRevocationServer(t, config)
+
+	certPEM, _, err := config.CreateCert("revoked.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := parseLeaf(t, certPEM)
+	if len(cert.OCSPServer) != 1 || len(cert.CRLDistributionPoints) != 1 {
+		t.Fatalf("expected revocation urls in the leaf, got %v %v", cert.OCSPServer, cert.CRLDistributionPoints)
+	}
+
+	if status := queryOcsp(t, config, cert, false).Status; status != ocsp.Good {
+		t.Fatalf("expected good before revocation, got %d", status)
+	}
+
+	serialNumber, err := server.Revoke(string(certPEM), ocsp.KeyCompromise)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serialNumber.Cmp(cert.SerialNumber) != 0 {
+		t.Fatalf("revoked serial %s, expected %s", serialNumber, cert.SerialNumber)
+	}
+
+	for _, useGet := range []bool{false, true} {
+		response := queryOcsp(t, config, cert, useGet)
+		if response.Status != ocsp.Revoked || response.RevocationReason != ocsp.KeyCompromise {
+			t.Fatalf("expected revoked (get=%v), got %d reason %d", useGet, response.Status, response.RevocationReason)
+		}
+	}
+
+	response, err := http.Get(cert.CRLDistributionPoints[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	crlDer, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	crl, err := x509.ParseRevocationList(crlDer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = crl.CheckSignatureFrom(config.ca); err != nil {
+		t.Fatal(err)
+	}
+	if len(crl.RevokedCertificateEntries) != 1 || crl.RevokedCertificateEntries[0].SerialNumber.Cmp(cert.SerialNumber) != 0 {
+		t.Fatalf("expected the revoked serial in the crl, got %v", crl.RevokedCertificateEntries)
+	}
+
+	// revocations are persisted
+	restarted := startTestRevocationServer(t, config)
+	if _, ok := restarted.revoked[cert.SerialNumber.String()]; !ok {
+		t.Fatal("expected the revocation to be restored from disk")
+	}
+}
+
+func TestOcspGetWithDoubleSlash(t *testing.T) {
+	config := newTestCertConfig(t, nil)
+	startTestRevocationServer(t, config)
+
+	// find a request whose base64 contains "//", which ServeMux would clean and redirect
+	for serial := int64(1); serial < 100000; serial++ {
+		cert := &x509.Certificate{SerialNumber: big.NewInt(serial)}
+		request, err := ocsp.CreateRequest(cert, config.ca, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(base64.StdEncoding.EncodeToString(request), "//") {
+			continue
+		}
+		response := queryOcsp(t, config, cert, true)
+		if response.Status != ocsp.Good || response.SerialNumber.Cmp(cert.SerialNumber) != 0 {
+			t.Fatalf("unexpected response %d for serial %s", response.Status, response.SerialNumber)
+		}
+		return
+	}
+	t.Fatal("no request with // found")
+}
+
+func TestCrlUrlNeedsCrlSignKeyUsage(t *testing.T) {
+	key, err := generateKey(KeyTypeEcdsaP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a CA created before crl support
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Unblocked"},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := NewCertConfig(t.TempDir(), ca, key, "", KeyTypeEcdsaP256, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTestRevocationServer(t, config)
+
+	certPEM, _, err := config.CreateCert("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := parseLeaf(t, certPEM)
+	if len(cert.CRLDistributionPoints) != 0 || len(cert.OCSPServer) != 1 {
+		t.Fatalf("expected only an ocsp url, got %v %v", cert.OCSPServer, cert.CRLDistributionPoints)
+	}
+	if status := queryOcsp(t, config, cert, true).Status; status != ocsp.Good {
+		t.Fatalf("expected good, got %d", status)
+	}
+}
+
+func TestRevocationServerRejectsEd25519Ca(t *testing.T) {
+	config, err := NewCertConfig(t.TempDir(), nil, nil, KeyTypeEd25519, KeyTypeEcdsaP256, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := StartRevocationServer(config, "127.0.0.1:0")
+	if err == nil {
+		server.listener.Close()
+		t.Fatal("expected an Ed25519 CA to be rejected")
+	}
+	if !strings.Contains(err.Error(), "Ed25519") || config.revocationUrl != "" {
+		t.Fatalf("expected a clear error and no revocation urls in certificates, got %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// socketBinding is the local address, device and mark of a connection. ConnectArgs override SessionArgs.
+type socketBinding struct {
+	localAddr    *net.TCPAddr
+	bindToDevice string
+	socketMark   int
+}
+
+func getSocketBinding(connectArgs ConnectArgs, sessionArgs SessionArgs) (*socketBinding, error) {
+	localAddress := sessionArgs.LocalAddress
+	if connectArgs.LocalAddress != "" {
+		localAddress = connectArgs.LocalAddress
+	}
+	binding := &socketBinding{
+		bindToDevice: sessionArgs.BindToDevice,
+		socketMark:   sessionArgs.SocketMark,
+	}
+	if connectArgs.BindToDevice != "" {
+		binding.bindToDevice = connectArgs.BindToDevice
+	}
+	if connectArgs.SocketMark != 0 {
+		binding.socketMark = connectArgs.SocketMark
+	}
+	if localAddress != "" {
+		ip := net.ParseIP(localAddress)
+		if ip == nil {
+			return nil, fmt.Errorf("SOCKET_BIND_ERR invalid LocalAddress %s", localAddress)
+		}
+		binding.localAddr = &net.TCPAddr{IP: ip}
+	}
+	return binding, nil
+}
+
+// dialer binds sockets for the network (eg, dns queries over udp) to the local address, device and mark
+func (b *socketBinding) dialer(network string) *net.Dialer {
+	dialer := &net.Dialer{Control: ConfigureSocket(0, 0, b.bindToDevice, b.socketMark)}
+	if b.localAddr != nil {
+		if strings.HasPrefix(network, "udp") {
+			dialer.LocalAddr = &net.UDPAddr{IP: b.localAddr.IP}
+		} else {
+			dialer.LocalAddr = b.localAddr
+		}
+	}
+	return dialer
+}
+
+// ValidateSocketBinding binds a socket with the session local address, device and mark so configuration errors
+// (an address that isn't assigned to this host, a missing device, no CAP_NET_ADMIN for marks) surface at startup
+func ValidateSocketBinding(sessionArgs SessionArgs) error {
+	if sessionArgs.LocalAddress == "" && sessionArgs.BindToDevice == "" && sessionArgs.SocketMark == 0 {
+		return nil
+	}
+	binding, err := getSocketBinding(ConnectArgs{}, sessionArgs)
+	if err != nil {
+		return err
+	}
+	address := ":0"
+	if binding.localAddr != nil {
+		address = net.JoinHostPort(binding.localAddr.IP.String(), "0")
+	}
+	listenConfig := net.ListenConfig{Control: ConfigureSocket(0, 0, binding.bindToDevice, binding.socketMark)}
+	conn, err := listenConfig.ListenPacket(context.Background(), "udp", address)
+	if err != nil {
+		return fmt.Errorf("SOCKET_BIND_ERR unable to bind outgoing connections (%s)", err)
+	}
+	return conn.Close()
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/pem"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	tls "github.com/refraction-networking/utls"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+const (
+	handshakeTypeServerHello    = 0x02
+	handshakeTypeServerKeyExch  = 0x0c
+	ecCurveTypeNamedCurve       = 0x03
+	maxRecordedServerHandshake  = 256 * 1024
+	recordHeaderLength          = 5
+	handshakeHeaderLength       = 4
+	serverHelloRandomAndVersion = 2 + 32
+)
+
+// handshakeRecorder keeps the plaintext handshake records sent by the server. utls doesn't expose the negotiated
+// key exchange group, so it's read from the ServerHello (tls 1.3) or ServerKeyExchange (tls 1.2).
+type handshakeRecorder struct {
+	net.Conn
+	sync.Mutex
+	received []byte
+	// checked without the lock so reads after the handshake only pay for an atomic load
+	isRecording atomic.Bool
+}
+
+func newHandshakeRecorder(conn net.Conn) *handshakeRecorder {
+	recorder := &handshakeRecorder{Conn: conn}
+	recorder.isRecording.Store(true)
+	return recorder
+}
+
+func (r *handshakeRecorder) Read(b []byte) (int, error) {
+	n, err := r.Conn.Read(b)
+	if n > 0 && r.isRecording.Load() {
+		r.Lock()
+		if r.isRecording.Load() {
+			r.received = append(r.received, b[:n]...)
+			if len(r.received) > maxRecordedServerHandshake {
+				r.isRecording.Store(false)
+			}
+		}
+		r.Unlock()
+	}
+	return n, err
+}
+
+// Stop recording and return the key exchange group the server selected (0 if unknown)
+func (r *handshakeRecorder) Stop() tls.CurveID {
+	r.Lock()
+	defer r.Unlock()
+	r.isRecording.Store(false)
+	received := r.received
+	r.received = nil
+	return findKeyExchangeGroup(received)
+}
+
+func findKeyExchangeGroup(received []byte) tls.CurveID {
+	// reassemble the handshake messages until encryption starts (change cipher spec or an application record)
+	var handshake []byte
+	s := cryptobyte.String(received)
+	for len(s) >= recordHeaderLength {
+		var recordType uint8
+		var version uint16
+		var fragment cryptobyte.String
+		if !s.ReadUint8(&recordType) || !s.ReadUint16(&version) || !s.ReadUint16LengthPrefixed(&fragment) {
+			break
+		}
+		if recordType != recordTypeHandshake {
+			break
+		}
+		handshake = append(handshake, fragment...)
+	}
+
+	var group tls.CurveID
+	messages := cryptobyte.String(handshake)
+	for len(messages) >= handshakeHeaderLength {
+		var messageType uint8
+		var body cryptobyte.String
+		if !messages.ReadUint8(&messageType) || !messages.ReadUint24LengthPrefixed(&body) {
+			break
+		}
+		switch messageType {
+		case handshakeTypeServerHello:
+			// a HelloRetryRequest is also a ServerHello. The last one wins.
+			if serverHelloGroup := readServerHelloKeyShare(body); serverHelloGroup != 0 {
+				group = serverHelloGroup
+			}
+		case handshakeTypeServerKeyExch:
+			var curveType uint8
+			var namedCurve uint16
+			if body.ReadUint8(&curveType) && curveType == ecCurveTypeNamedCurve && body.ReadUint16(&namedCurve) {
+				group = tls.CurveID(namedCurve)
+			}
+		}
+	}
+	return group
+}
+
+func readServerHelloKeyShare(body cryptobyte.String) tls.CurveID {
+	var sessionId, extensions cryptobyte.String
+	if !body.Skip(serverHelloRandomAndVersion) ||
+		!body.ReadUint8LengthPrefixed(&sessionId) ||
+		!body.Skip(2+1) ||
+		!body.ReadUint16LengthPrefixed(&extensions) {
+		return 0
+	}
+	for !extensions.Empty() {
+		var extension, group uint16
+		var data cryptobyte.String
+		if !extensions.ReadUint16(&extension) || !extensions.ReadUint16LengthPrefixed(&data) {
+			return 0
+		}
+		// both the ServerHello key share and the HelloRetryRequest selected group start with the group id
+		if extension == extensionKeyShare && data.ReadUint16(&group) {
+			return tls.CurveID(group)
+		}
+	}
+	return 0
+}
+
+func peerCertificatesPem(state tls.ConnectionState) []string {
+	certificates := make([]string, len(state.PeerCertificates))
+	for i, certificate := range state.PeerCertificates {
+		certificates[i] = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw}))
+	}
+	return certificates
+}
+
+// offeredAlpsCodepoint returns the ALPS extension sent in our ClientHello. The server's answer is in the encrypted
+// extensions, which utls doesn't expose, but servers can only answer with the codepoint they were offered.
+func offeredAlpsCodepoint(rawClientHello []byte) uint16 {
+	if hasClientHelloExtension(rawClientHello, extensionApplicationSettingsNew) {
+		return extensionApplicationSettingsNew
+	}
+	return extensionApplicationSettings
+}
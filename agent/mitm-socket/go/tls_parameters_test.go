@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	stdtls "crypto/tls"
+	"io"
+	"net"
+	"testing"
+
+	tls "github.com/refraction-networking/utls"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// emulateKeyExchangeGroup connects with the ClientHello of chrome 131 and returns the group the server selected
+func emulateKeyExchangeGroup(t *testing.T, addr string) (*tls.UConn, tls.CurveID) {
+	t.Helper()
+	uTlsConn, emulated, err := emulateTestTls(t, addr, SessionArgs{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uTlsConn, emulated.KeyExchangeGroup
+}
+
+// serverHelloRecord is a tls 1.3 ServerHello with a key share (or the selected group of a HelloRetryRequest)
+func serverHelloRecord(group tls.CurveID, keyExchange []byte) []byte {
+	var record cryptobyte.Builder
+	record.AddUint8(recordTypeHandshake)
+	record.AddUint16(tls.VersionTLS12)
+	record.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint8(handshakeTypeServerHello)
+		b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16(tls.VersionTLS12)
+			b.AddBytes(make([]byte, 32))
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {})
+			b.AddUint16(tls.TLS_AES_128_GCM_SHA256)
+			b.AddUint8(0)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint16(extensionKeyShare)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint16(uint16(group))
+					if keyExchange != nil {
+						b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(keyExchange) })
+					}
+				})
+			})
+		})
+	})
+	return record.BytesOrPanic()
+}
+
+// readerConn replays a server byte stream
+type readerConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *readerConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func TestKeyExchangeGroupAfterHelloRetryRequest(t *testing.T) {
+	// chrome only sends X25519MLKEM768 and X25519 key shares, so the server asks for P-384
+	addr, _ := startTestTlsServer(t, func(config *stdtls.Config) {
+		config.CurvePreferences = []stdtls.CurveID{stdtls.CurveP384}
+	})
+
+	uTlsConn, group := emulateKeyExchangeGroup(t, addr)
+	if group != tls.CurveP384 {
+		t.Fatalf("expected the group of the HelloRetryRequest, got %d", group)
+	}
+	if uTlsConn.ConnectionState().Version != tls.VersionTLS13 {
+		t.Fatal("expected a tls 1.3 connection")
+	}
+
+	// the HelloRetryRequest and the second ServerHello both carry the group, the last one wins
+	hrr := serverHelloRecord(tls.CurveP256, nil)
+	serverHello := serverHelloRecord(tls.CurveP384, make([]byte, 97))
+	if group = findKeyExchangeGroup(append(hrr, serverHello...)); group != tls.CurveP384 {
+		t.Fatalf("expected the group of the last ServerHello, got %d", group)
+	}
+}
+
+func TestKeyExchangeGroupFromTls12ServerKeyExchange(t *testing.T) {
+	addr, _ := startTestTlsServer(t, func(config *stdtls.Config) {
+		config.MaxVersion = stdtls.VersionTLS12
+		config.CurvePreferences = []stdtls.CurveID{stdtls.CurveP256}
+	})
+
+	uTlsConn, group := emulateKeyExchangeGroup(t, addr)
+	if uTlsConn.ConnectionState().Version != tls.VersionTLS12 {
+		t.Fatal("expected a tls 1.2 connection")
+	}
+	if group != tls.CurveP256 {
+		t.Fatalf("expected the named curve of the ServerKeyExchange, got %d", group)
+	}
+}
+
+func TestHandshakeRecorderStopsAtLimit(t *testing.T) {
+	serverHello := serverHelloRecord(tls.X25519, make([]byte, 32))
+	stream := append(serverHello, bytes.Repeat([]byte{0x17}, 2*maxRecordedServerHandshake)...)
+	recorder := newHandshakeRecorder(&readerConn{reader: bytes.NewReader(stream)})
+
+	buffer := make([]byte, 16*1024)
+	for {
+		if _, err := recorder.Read(buffer); err != nil {
+			break
+		}
+	}
+	if recorder.isRecording.Load() {
+		t.Fatal("expected recording to stop after the limit")
+	}
+	if len(recorder.received) > maxRecordedServerHandshake+len(buffer) {
+		t.Fatalf("expected at most %d recorded bytes, got %d", maxRecordedServerHandshake+len(buffer), len(recorder.received))
+	}
+	if group := recorder.Stop(); group != tls.X25519 {
+		t.Fatalf("expected the ServerHello group, got %d", group)
+	}
+
+	// reads after the handshake aren't recorded
+	recorder.Conn = &readerConn{reader: bytes.NewReader(serverHello)}
+	if _, err := recorder.Read(buffer); err != nil {
+		t.Fatal(err)
+	}
+	if recorder.received != nil {
+		t.Fatal("expected nothing to be recorded after Stop")
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+const defaultTlsSessionCacheSize = 256
+
+// TlsSessionCache is shared by all connections of a session so tls sessions are resumed like a browser
+// would (session tickets and tls 1.3 psk). It can be persisted across process restarts.
+type TlsSessionCache struct {
+	sync.Mutex
+	sessions map[string]*tlsSessionEntry
+	keys     []string
+	capacity int
+}
+
+type tlsSessionEntry struct {
+	session *tls.ClientSessionState
+	version uint16
+}
+
+// tls13SessionCache hides tls 1.2 sessions from specs without a session_ticket extension (utls can't resume them)
+type tls13SessionCache struct {
+	*TlsSessionCache
+}
+
+type persistedTlsSession struct {
+	Ticket []byte
+	State  []byte
+}
+
+var tlsSessionCache *TlsSessionCache
+
+func NewTlsSessionCache(capacity int) *TlsSessionCache {
+	if capacity < 1 {
+		capacity = defaultTlsSessionCacheSize
+	}
+	return &TlsSessionCache{
+		sessions: make(map[string]*tlsSessionEntry),
+		capacity: capacity,
+	}
+}
+
+// ForSpec returns a cache that only resumes sessions the ClientHelloSpec can represent
+func (c *TlsSessionCache) ForSpec(spec *tls.ClientHelloSpec) tls.ClientSessionCache {
+	for _, ext := range spec.Extensions {
+		if _, ok := ext.(*tls.SessionTicketExtension); ok {
+			return c
+		}
+	}
+	return &tls13SessionCache{c}
+}
+
+func (c *TlsSessionCache) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	c.Lock()
+	defer c.Unlock()
+	entry, ok := c.sessions[sessionKey]
+	if !ok {
+		return nil, false
+	}
+	return entry.session, true
+}
+
+func (c *tls13SessionCache) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	c.Lock()
+	defer c.Unlock()
+	entry, ok := c.sessions[sessionKey]
+	if !ok || entry.version < tls.VersionTLS13 {
+		return nil, false
+	}
+	return entry.session, true
+}
+
+func (c *TlsSessionCache) Put(sessionKey string, session *tls.ClientSessionState) {
+	c.Lock()
+	defer c.Unlock()
+
+	if _, exists := c.sessions[sessionKey]; exists {
+		c.removeKey(sessionKey)
+	}
+	if session == nil {
+		delete(c.sessions, sessionKey)
+		return
+	}
+
+	// evict oldest
+	if len(c.keys) >= c.capacity {
+		delete(c.sessions, c.keys[0])
+		c.keys = c.keys[1:]
+	}
+	c.sessions[sessionKey] = &tlsSessionEntry{session: session, version: sessionVersion(session)}
+	c.keys = append(c.keys, sessionKey)
+}
+
+func sessionVersion(session *tls.ClientSessionState) uint16 {
+	_, state, err := session.ResumptionState()
+	if err != nil || state == nil {
+		return 0
+	}
+	// serialized session state starts with the protocol version
+	stateBytes, err := state.Bytes()
+	if err != nil || len(stateBytes) < 2 {
+		return 0
+	}
+	return uint16(stateBytes[0])<<8 | uint16(stateBytes[1])
+}
+
+func (c *TlsSessionCache) removeKey(sessionKey string) {
+	for i, key := range c.keys {
+		if key == sessionKey {
+			c.keys = append(c.keys[:i], c.keys[i+1:]...)
+			return
+		}
+	}
+}
+
+func (c *TlsSessionCache) Save(path string) error {
+	c.Lock()
+	persisted := make(map[string]persistedTlsSession)
+	for _, key := range c.keys {
+		ticket, state, err := c.sessions[key].session.ResumptionState()
+		if err != nil || state == nil {
+			continue
+		}
+		stateBytes, err := state.Bytes()
+		if err != nil {
+			continue
+		}
+		persisted[key] = persistedTlsSession{Ticket: ticket, State: stateBytes}
+	}
+	c.Unlock()
+
+	sessionsJson, err := json.Marshal(persisted)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, sessionsJson, 0600)
+}
+
+func (c *TlsSessionCache) Load(path string) error {
+	sessionsJson, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	persisted := make(map[string]persistedTlsSession)
+	err = json.Unmarshal(sessionsJson, &persisted)
+	if err != nil {
+		return err
+	}
+
+	for key, session := range persisted {
+		state, err := tls.ParseSessionState(session.State)
+		if err != nil {
+			// skip sessions written by an incompatible version
+			continue
+		}
+		resumptionState, err := tls.NewResumptionState(session.Ticket, state)
+		if err != nil {
+			continue
+		}
+		c.Put(key, resumptionState)
+	}
+	return nil
+}
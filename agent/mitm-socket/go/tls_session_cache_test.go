@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// connectAndRead reads the server greeting, which processes the tls 1.3 NewSessionTicket sent before it
+func connectAndRead(t *testing.T, addr string, sessionArgs SessionArgs) *tls.UConn {
+	t.Helper()
+	uTlsConn, err := emulateTestConnection(t, addr, sessionArgs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	greeting := make([]byte, 2)
+	if _, err = io.ReadFull(uTlsConn, greeting); err != nil {
+		t.Fatal(err)
+	}
+	return uTlsConn
+}
+
+func TestTlsSessionResumption(t *testing.T) {
+	addr, _ := startTestTlsServer(t, nil)
+	setTestGlobal(t, &tlsSessionCache, NewTlsSessionCache(10))
+
+	first := connectAndRead(t, addr, SessionArgs{})
+	if first.ConnectionState().DidResume || len(first.HandshakeState.Hello.PskIdentities) != 0 {
+		t.Fatal("expected a full handshake without a pre_shared_key extension")
+	}
+
+	second := connectAndRead(t, addr, SessionArgs{})
+	if !second.ConnectionState().DidResume || len(second.HandshakeState.Hello.PskIdentities) == 0 {
+		t.Fatal("expected the second connection to resume the session")
+	}
+
+	// sessions survive a restart
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	if err := tlsSessionCache.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	tlsSessionCache = NewTlsSessionCache(10)
+	if err := tlsSessionCache.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if !connectAndRead(t, addr, SessionArgs{}).ConnectionState().DidResume {
+		t.Fatal("expected a restored session to be resumed")
+	}
+}
+
+func TestTlsSessionCacheKeepsNonPskFingerprint(t *testing.T) {
+	addr, _ := startTestTlsServer(t, nil)
+	definition := parseTestDefinition(t, chromeLikeDefinition)
+	definition.Extensions = slices.DeleteFunc(definition.Extensions, func(ext ClientHelloExtensionDefinition) bool {
+		return ext.Id == extensionPskKeyExchangeModes
+	})
+	sessionArgs := SessionArgs{ClientHelloSpec: definition}
+	ja4 := func(uTlsConn *tls.UConn) string {
+		fingerprint, err := FingerprintClientHello(uTlsConn.HandshakeState.Hello.Raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fingerprint.Ja4
+	}
+
+	withoutCache := ja4(connectAndRead(t, addr, sessionArgs))
+	setTestGlobal(t, &tlsSessionCache, NewTlsSessionCache(10))
+	// a chrome connection stores a tls 1.3 session for the server
+	connectAndRead(t, addr, SessionArgs{})
+	withCache := connectAndRead(t, addr, sessionArgs)
+	if withCache.ConnectionState().DidResume || len(withCache.HandshakeState.Hello.PskIdentities) != 0 {
+		t.Fatal("expected a profile without psk_key_exchange_modes not to offer the session")
+	}
+	if ja4(withCache) != withoutCache {
+		t.Fatalf("expected the session cache not to change the fingerprint %s, got %s", withoutCache, ja4(withCache))
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// nil uses the system roots
+var rootCas *x509.CertPool
+
+// base64 sha256 hashes of SubjectPublicKeyInfo, keyed by host (see findByHost)
+var spkiPins map[string][]string
+
+// PinMismatchError is returned when none of the certificates a server presented match the pins for the host
+type PinMismatchError struct {
+	Host string
+}
+
+func (e *PinMismatchError) Error() string {
+	return fmt.Sprintf("Certificate chain for %s does not match any configured SPKI pin", e.Host)
+}
+
+// InitTrustStore builds the root pool and certificate pins. Both are only used when RejectUnauthorized is set.
+func InitTrustStore(sessionArgs SessionArgs) error {
+	spkiPins = make(map[string][]string)
+	for host, pins := range sessionArgs.SpkiPins {
+		for _, pin := range pins {
+			// allow the HPKP/curl notation (sha256//base64)
+			pin = strings.TrimPrefix(strings.TrimPrefix(pin, "sha256//"), "sha256/")
+			hash, err := base64.StdEncoding.DecodeString(pin)
+			if err != nil || len(hash) != sha256.Size {
+				return fmt.Errorf("Invalid SPKI pin for %s. Expected a base64 sha256 hash (%s)", host, pin)
+			}
+			spkiPins[strings.ToLower(host)] = append(spkiPins[strings.ToLower(host)], pin)
+		}
+	}
+
+	if sessionArgs.RootCaPem == "" && sessionArgs.RootCaPath == "" {
+		rootCas = nil
+		return nil
+	}
+
+	pool := x509.NewCertPool()
+	if !sessionArgs.ReplaceSystemRootCas {
+		systemPool, err := x509.SystemCertPool()
+		if err != nil {
+			return err
+		}
+		pool = systemPool
+	}
+
+	bundle := []byte(sessionArgs.RootCaPem)
+	if sessionArgs.RootCaPath != "" {
+		fromFile, err := os.ReadFile(sessionArgs.RootCaPath)
+		if err != nil {
+			return err
+		}
+		bundle = append(append(bundle, '\n'), fromFile...)
+	}
+	if !pool.AppendCertsFromPEM(bundle) {
+		return errors.New("No certificates could be parsed from the root CA bundle")
+	}
+	rootCas = pool
+	return nil
+}
+
+// verifySpkiPins checks that at least one certificate in the chain has a pinned public key
+func verifySpkiPins(host string, state tls.ConnectionState) error {
+	pins, ok := findByHost(spkiPins, host)
+	if !ok {
+		return nil
+	}
+
+	// only verified chains are checked so a pinned root/intermediate can't be claimed by an unrelated leaf
+	for _, chain := range state.VerifiedChains {
+		for _, certificate := range chain {
+			hash := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+			encoded := base64.StdEncoding.EncodeToString(hash[:])
+			for _, pin := range pins {
+				if pin == encoded {
+					return nil
+				}
+			}
+		}
+	}
+	return &PinMismatchError{Host: host}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"testing"
+)
+
+func spkiPin(certificate *x509.Certificate) string {
+	hash := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func initTestTrustStore(t *testing.T, ca *x509.Certificate, pins map[string][]string) {
+	t.Helper()
+	setTestGlobal(t, &rootCas, nil)
+	setTestGlobal(t, &spkiPins, nil)
+	err := InitTrustStore(SessionArgs{
+		RootCaPem:            string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})),
+		ReplaceSystemRootCas: true,
+		SpkiPins:             pins,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSpkiPinMismatch(t *testing.T) {
+	addr, certConfig := startTestTlsServer(t, nil)
+	otherCa := newTestCertConfig(t, nil).ca
+	initTestTrustStore(t, certConfig.ca, map[string][]string{"*.example.com": {spkiPin(otherCa)}})
+
+	_, err := emulateTestConnection(t, addr, SessionArgs{RejectUnauthorized: true}, nil)
+	var pinMismatch *PinMismatchError
+	if !errors.As(err, &pinMismatch) || pinMismatch.Host != "ech.example.com" {
+		t.Fatalf("expected a pin mismatch for ech.example.com, got %v", err)
+	}
+
+	// pins are only checked when certificates are verified
+	if _, err = emulateTestConnection(t, addr, SessionArgs{}, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSpkiPinMatchesCa(t *testing.T) {
+	addr, certConfig := startTestTlsServer(t, nil)
+	initTestTrustStore(t, certConfig.ca, map[string][]string{"ech.example.com": {spkiPin(newTestCertConfig(t, nil).ca), "sha256//" + spkiPin(certConfig.ca)}})
+
+	if _, err := emulateTestConnection(t, addr, SessionArgs{RejectUnauthorized: true}, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInvalidSpkiPin(t *testing.T) {
+	setTestGlobal(t, &spkiPins, nil)
+	if err := InitTrustStore(SessionArgs{SpkiPins: map[string][]string{"example.com": {"c2hvcnQ="}}}); err == nil {
+		t.Fatal("expected a pin that isn't a sha256 hash to be rejected")
+	}
+}
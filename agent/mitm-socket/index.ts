@@ -34,6 +34,40 @@ export default class MitmSocket
     acceptCh?: { domain: string; headers: string[] };
   };
 
+  public clientHelloProfile?: string;
+  public clientHello?: {
+    ja3: string;
+    ja3Hash: string;
+    ja4: string;
+    ja4r: string;
+    raw: Buffer;
+  };
+
+  public isTlsResumed = false;
+  public tls?: {
+    version: string;
+    cipherSuite: string;
+    keyExchangeGroup?: string;
+    peerCertificates: string[]; // PEM, leaf first
+    ocspResponse?: Buffer;
+    signedCertificateTimestamps: Buffer[];
+    alpsCodepoint?: number;
+  };
+  public clientCertificate?: {
+    subject: string;
+    issuer: string;
+    serialNumber: string;
+    sha256Fingerprint: string;
+  };
+  public ech?: {
+    status: 'accepted' | 'grease' | 'rejected';
+    retryConfigs?: Buffer;
+  };
+
+  public ipFamily?: 'ipv4' | 'ipv6';
+  // happy eyeballs attempts that failed or lost the race
+  public losingDialAttempts: { address: string; error: string; durationMs: number }[] = [];
+
   public socket: net.Socket;
   public dnsResolvedIp: string;
   public remoteAddress: string;
@@ -103,6 +137,11 @@ export default class MitmSocket
     this.connectOpts.proxyUrl = url;
   }
 
+  // the first proxy is connected to directly, every next one through the previous
+  public setProxyUrls(urls: string[]): void {
+    this.connectOpts.proxyUrls = urls;
+  }
+
   public isHttp2(): boolean {
     return this.alpn === 'h2';
   }
@@ -214,6 +253,51 @@ export default class MitmSocket
           }),
         };
       }
+      this.clientHelloProfile = message.clientHelloProfile;
+      if (message.rawClientHello) {
+        this.clientHello = {
+          ja3: message.ja3,
+          ja3Hash: message.ja3Hash,
+          ja4: message.ja4,
+          ja4r: message.ja4r,
+          raw: Buffer.from(message.rawClientHello, 'base64'),
+        };
+      }
+      this.isTlsResumed = message.resumed === true;
+      if (message.tlsVersion) {
+        this.tls = {
+          version: message.tlsVersion,
+          cipherSuite: message.cipherSuite,
+          keyExchangeGroup: message.keyExchangeGroup,
+          peerCertificates: message.peerCertificates ?? [],
+          ocspResponse: message.ocspResponse
+            ? Buffer.from(message.ocspResponse, 'base64')
+            : undefined,
+          signedCertificateTimestamps: (message.signedCertificateTimestamps ?? []).map(x =>
+            Buffer.from(x, 'base64'),
+          ),
+          alpsCodepoint: message.alpsCodepoint,
+        };
+      }
+      if (message.clientCertificate) {
+        this.clientCertificate = {
+          subject: message.clientCertificate.Subject,
+          issuer: message.clientCertificate.Issuer,
+          serialNumber: message.clientCertificate.SerialNumber,
+          sha256Fingerprint: message.clientCertificate.Sha256Fingerprint,
+        };
+      }
+      if (message.ech) {
+        this.ech = { status: message.ech };
+        if (message.echRetryConfigs) {
+          this.ech.retryConfigs = Buffer.from(message.echRetryConfigs, 'base64');
+        }
+      }
+      this.ipFamily = message.ipFamily;
+      this.losingDialAttempts = (message.losingDialAttempts ?? []).map(x => {
+        return { address: x.Address, error: x.Error, durationMs: x.DurationMs };
+      });
+      if (message.dnsResolvedIp) this.dnsResolvedIp = message.dnsResolvedIp;
       this.remoteAddress = message.remoteAddress;
       this.localAddress = message.localAddress;
       this.emit('connect');
@@ -259,7 +343,10 @@ export default class MitmSocket
       message.includes('connection refused') ||
       message.includes('no such host') ||
       message.includes('Dial (proxy/remote)') ||
-      message.includes('PROXY_ERR')
+      message.includes('PROXY_ERR') ||
+      message.includes('SOCKET_BIND_ERR') ||
+      message.includes('SO_BINDTODEVICE') ||
+      message.includes('SO_MARK')
     ) {
       this.connectError = message.trim();
       if (this.connectError.includes('Error:')) {
@@ -11,6 +11,7 @@ import { createIpcSocketPath } from '@ulixee/commons/lib/IpcUtils';
 import { nanoid } from 'nanoid';
 import * as Fs from 'fs';
 import * as Path from 'path';
+import { IClientCertificate } from '@ulixee/unblocked-specification/agent/net/IHttpSocketConnectOptions';
 
 const ext = os.platform() === 'win32' ? '.exe' : '';
 const libPath = Path.join(
@@ -221,12 +222,142 @@ export default abstract class BaseIpcHandler {
 export interface IGoIpcOpts {
   mode?: 'certs' | 'proxy';
   storageDir?: string;
+  // certs mode: where the generated CA and keys are stored. Defaults to storageDir
+  certStorageDir?: string;
+  // certs mode: key algorithms of a generated CA and of leaf certificates. Defaults to rsa-2048
+  caKeyType?: ICertKeyType;
+  leafKeyType?: ICertKeyType;
+  // certs mode: reuse an existing CA. PEM or DER cert + key, or a PKCS#12 bundle (RSA or ECDSA keys)
+  caCertPath?: string;
+  caKeyPath?: string;
+  caPkcs12Path?: string;
+  caPkcs12Password?: string;
+  // certs mode: sign with a CA key on a PKCS#11 token (HSM, SoftHSM2). caCertPath optionally provides the CA cert.
+  // Released connect binaries are built with cgo. Local builds need CGO_ENABLED=1 and a C compiler.
+  caPkcs11?: ICaPkcs11;
+  // certs mode: serve a local OCSP responder and CRL (eg, 127.0.0.1:0). Leaf certificates embed their urls.
+  // Needs an rsa or ecdsa CA (OCSP responses can't be signed with ed25519).
+  revocationServerAddress?: string;
+  // certs mode: limit the names a generated CA can issue certificates for
+  caNameConstraints?: ICaNameConstraints;
+  // certs mode: days before CA expiry to warn (default 60) and to rotate a generated CA (default 30)
+  caExpiryWarningDays?: number;
+  caRotationDays?: number;
+  disableCaRotation?: boolean;
+  // certs mode: generated leaf certificates are cached (lru) and can be persisted and pre-generated
+  disableCertCache?: boolean;
+  certCacheSize?: number;
+  certCachePath?: string;
+  certCacheWarmupHosts?: string[];
   userAgent?: string;
   ipcSocketPath?: string;
   clientHelloId?: string;
+  clientHelloSpec?: IClientHelloDefinition;
+  clientHelloRaw?: string; // hex or base64 ClientHello record, eg, captured by the double-agent tls-server
+  clientHelloProfile?: string; // name of a <name>.json definition or <name>.raw capture
+  clientHelloProfilesDir?: string;
+  // override the browser version -> ClientHello table per browser (eg, { chrome: { ranges: [...] } })
+  clientHelloVersionsPath?: string;
+  clientHelloVersions?: { [browser: string]: IClientHelloBrowserVersions };
+  // tls sessions are resumed across connections of a session unless disabled
+  disableTlsSessionCache?: boolean;
+  tlsSessionCacheSize?: number;
+  tlsSessionCachePath?: string; // persist resumable sessions across restarts
+  // trust store used when rejectUnauthorized is set
+  rootCaPem?: string;
+  rootCaPath?: string;
+  replaceSystemRootCas?: boolean;
+  spkiPins?: { [host: string]: string[] }; // base64 sha256 of SubjectPublicKeyInfo. Host or *.domain
+  clientCertificates?: { [host: string]: IClientCertificate }; // host or *.domain
+  // direct connections race ipv6 and ipv4 addresses (happy eyeballs) unless ipFamily restricts them to one family
+  ipFamily?: 'ipv4' | 'ipv6';
+  preferredIpFamily?: 'ipv4' | 'ipv6'; // default ipv6
+  happyEyeballsAttemptDelayMs?: number; // default 250
+  // resolver for direct connection hostnames (default system). Proxies resolve hostnames themselves.
+  dnsResolver?: IDnsResolver;
+  // answers (and ECHConfigLists from HTTPS records) are cached for their ttl and shared by all connections of a session
+  disableDnsCache?: boolean;
+  dnsCacheSize?: number;
+  // Chrome --host-resolver-rules for direct connections, eg, 'MAP *.example.com 127.0.0.1:8443, EXCLUDE api.example.com'
+  hostResolverRules?: string;
+  // local ip address, network interface (linux SO_BINDTODEVICE) and fwmark (linux SO_MARK) of outgoing connections.
+  // Validated when the session starts.
+  localAddress?: string;
+  bindToDevice?: string;
+  socketMark?: number;
+  // host:port of a dns server to look up ECHConfigLists in HTTPS records. A dnsResolver other than system is used instead.
+  echDnsServer?: string;
   tcpTtl?: number;
   tcpWindowSize?: number;
   rejectUnauthorized?: boolean;
   debug?: boolean;
   debugData?: boolean; // include bytes read from client/remote (NOTE: lots of output)
 }
+
+export interface ICaPkcs11 {
+  modulePath: string; // eg, /usr/lib/softhsm/libsofthsm2.so
+  tokenLabel?: string;
+  slotId?: number;
+  pin?: string;
+  pinEnv?: string; // environment variable with the pin (keeps it out of the process arguments)
+  keyLabel?: string;
+  keyId?: string; // hex
+}
+
+export interface IDnsResolver {
+  type: 'system' | 'udp' | 'tcp' | 'doh' | 'dot';
+  server?: string; // host:port (udp, tcp, dot) or https url (doh), eg, https://1.1.1.1/dns-query
+  serverName?: string; // dot: certificate name when server is an ip address
+  fallbackToSystem?: boolean; // Chrome's "automatic" Secure DNS mode
+}
+
+export interface ICaNameConstraints {
+  permittedDnsDomains?: string[]; // a domain matches itself and subdomains, ".domain" only subdomains
+  excludedDnsDomains?: string[];
+  permittedIpRanges?: string[]; // CIDR notation
+  excludedIpRanges?: string[];
+}
+
+export type ICertKeyType =
+  | 'rsa-2048'
+  | 'rsa-3072'
+  | 'rsa-4096'
+  | 'ecdsa-p256'
+  | 'ecdsa-p384'
+  | 'ed25519';
+
+// NOTE: any GREASE value (0x?a?a) is regenerated per connection
+export interface IClientHelloDefinition {
+  tlsVersMin?: number;
+  tlsVersMax?: number;
+  cipherSuites: number[];
+  compressionMethods?: number[];
+  extensions: {
+    id: number;
+    data?: string; // base64 payload for extensions not modeled by the Go library
+    protocols?: string[];
+    versions?: number[];
+    groups?: number[];
+    keyShares?: { group: number; data?: string }[];
+    signatureAlgorithms?: number[];
+    pointFormats?: number[];
+    pskModes?: number[];
+    certCompressionAlgorithms?: number[];
+    recordSizeLimit?: number;
+    paddingStyle?: 'boring' | 'fixed';
+    paddingLength?: number;
+  }[];
+  shuffleExtensions?: boolean;
+}
+
+export interface IClientHelloBrowserVersions {
+  extends?: string;
+  ranges: {
+    minVersion?: number; // inclusive
+    maxVersion?: number; // inclusive
+    utlsId?: string; // eg, HelloChrome_133
+    profile?: string;
+    spec?: IClientHelloDefinition;
+    note?: string;
+  }[];
+}
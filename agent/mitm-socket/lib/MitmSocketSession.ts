@@ -46,6 +46,15 @@ export default class MitmSocketSession extends BaseIpcHandler {
     }
     if (message?.id) {
       this.socketsById.get(message.id)?.onMessage(message);
+    } else if (message?.status === 'error') {
+      // session startup errors (eg, socketBinding) fail the sockets waiting for the session
+      this.logger.error('MitmSocketSession.error', {
+        step: message['error-step'],
+        error: message.error,
+      });
+      for (const socket of this.socketsById.values()) {
+        socket.onMessage(message);
+      }
     }
   }
 
@@ -8,4 +8,19 @@ export default interface IHttpSocketConnectOptions {
   isWebsocket?: boolean;
   keylogPath?: string;
   proxyUrl?: string;
+  proxyUrls?: string[]; // proxy chain, each hop tunnels through the previous one. Use instead of proxyUrl.
+  echConfigList?: string; // base64 ECHConfigList
+  clientCertificate?: IClientCertificate;
+  // override the session localAddress, bindToDevice and socketMark
+  localAddress?: string;
+  bindToDevice?: string;
+  socketMark?: number;
+}
+
+// presented when the server requests a client certificate. Provide a PEM cert + key or a PKCS#12 bundle.
+export interface IClientCertificate {
+  certPem?: string;
+  keyPem?: string;
+  pkcs12?: string; // base64
+  pkcs12Password?: string;
 }